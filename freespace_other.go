@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || openbsd || windows)
+
+package main
+
+import "errors"
+
+// Free space cannot be queried on this platform
+func availableSpace(path string) (uint64, error) {
+	return 0, errors.New("free space check is not supported on this platform")
+}
@@ -1,3 +1,12 @@
 module github.com/Strong-Foundation/nclonline-com-documentation
 
 go 1.24.5
+
+require (
+	github.com/ledongthuc/pdf v0.0.0-20250511090121-5959a4027728
+	golang.org/x/net v0.50.0
+	golang.org/x/sys v0.41.0
+	golang.org/x/term v0.40.0
+)
+
+require golang.org/x/text v0.34.0 // indirect
@@ -1,18 +1,475 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
 	"io"
 	"log"
+	"maps"
+	"math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/net/proxy"
+	"golang.org/x/term"
+)
+
+// A flag that can be given multiple times, collecting every value
+type stringListFlag []string
+
+func (list *stringListFlag) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringListFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// Defines a repeatable string flag
+func listFlag(name string, usage string) *stringListFlag {
+	list := new(stringListFlag)
+	flag.Var(list, name, usage)
+	return list
+}
+
+// Command-line flags
+var (
+	showTimings          = flag.Bool("timings", false, "Report the time spent scraping, extracting and downloading at the end of the run")
+	printVersion         = flag.Bool("version", false, "Print the version, commit and build date, then exit")
+	logLevel             = flag.String("log-level", "info", "Logging verbosity: info or debug")
+	validatePDFStructure = flag.Bool("validate-pdf-structure", false, "Parse each downloaded PDF and quarantine files with a broken trailer/xref or no pages")
+	stripParams          = flag.String("strip-params", "utm_*,ref,fbclid", "Comma-separated query parameter names (glob patterns allowed) removed from PDF links before dedupe and naming")
+	normalizeWhitespace  = flag.Bool("normalize-whitespace", false, "Strip line breaks and padding inside attribute values before extracting links from malformed pages")
+	aggressiveExtract    = flag.Bool("aggressive-extract", false, "Also take PDF links from data-* attributes and window.open/location.href strings in scripts (may find false positives)")
+	listProducts         = flag.Bool("list-products", false, "Scrape (or read from -http-cache) and print each product's slug, name and SDS count, sorted by slug, instead of downloading")
+	outputFormat         = flag.String("format", "table", "Output format for -list-products: table, csv or json")
+	oneURL               = flag.String("one", "", "Download this single PDF URL to stdout (e.g. -one URL > out.pdf) and exit; logs go to stderr")
+	resolveOnly          = flag.String("resolve-only", "", "Print the filename each URL in this file (a -urls list of PDFs or -dump-links output) would be saved under as CSV, flagging collisions, without network access, then exit")
+	dumpLinks            = flag.String("dump-links", "", "Scrape and write every resolved PDF URL (sorted, one per line) to this file instead of downloading")
+	reportHTML           = flag.Bool("report-html", false, "Regenerate index.html in the output directory listing every downloaded SDS")
+	dedupeReport         = flag.String("dedupe-report", "", "Write the groups of product page and PDF URLs that normalization merged into one, as JSON, to this file")
+	writeReferences      = flag.Bool("write-references", false, "Write references.json listing the product pages that link each PDF")
+	pruneOrphans         = flag.Bool("prune", false, "After a complete, unfiltered scrape, list local files no longer referenced by any product page (dry run unless -prune-confirm)")
+	pruneConfirm         = flag.Bool("prune-confirm", false, "Actually move the files found by -prune into the _removed/ subdirectory, after confirmation")
+	onCollision          = flag.String("on-collision", "skip", "When two URLs map to the same filename: skip, overwrite, or suffix (save as name_2.pdf, name_3.pdf, ...)")
+	minFreeSpace         = flag.Int64("min-free-space", 0, "Abort before downloading if the output directory's filesystem has fewer free bytes than this; 0 disables the check")
+	minPages             = flag.Int("min-pages", 0, "Reject downloaded PDFs with fewer pages than this (e.g. 2 to drop one-page placeholders); PDFs whose pages can't be counted are kept")
+	minFileSize          = flag.Int64("min-filesize", 1, "Reject downloads smaller than this many bytes (e.g. 1024 to drop tiny error PDFs)")
+	throttleOnError      = flag.Bool("throttle-on-error", false, "Slow down automatically while the server is returning errors, recovering as requests succeed again")
+	throttleWindow       = flag.Int("throttle-window", 20, "Number of recent requests the -throttle-on-error error rate is measured over")
+	throttleThreshold    = flag.Float64("throttle-threshold", 0.3, "Error rate (0-1) over the window at which requests start being delayed")
+	throttleMaxDelay     = flag.Duration("throttle-max-delay", 30*time.Second, "Longest delay -throttle-on-error inserts before a request")
+	retryBudgetFlag      = flag.Int64("retry-budget", 0, "Most extra attempts (429 retries, mirror failovers and -retry-on-content-mismatch retries) across the whole run, all drawn from the same allowance; once spent, failures are not retried. 0 means unlimited")
+	maxRetryAfter        = flag.Duration("max-retry-after", 5*time.Minute, "Longest Retry-After wait honored for a 429 response; longer waits are capped")
+	baseURLFlag          = flag.String("base-url", "", "Scrape and download from this site instead of "+defaultBaseURL+" (e.g. a staging host)")
+	dedupeAcrossRuns     = flag.Bool("dedupe-across-runs", false, "Skip URLs the manifest records as downloaded by an earlier run, without any request")
+	noSkipExisting       = flag.Bool("no-skip-existing", false, "Download URLs whose files already exist and replace a file only if the new content differs (gentler than -force)")
+	forceDownload        = flag.Bool("force", false, "Download every URL again, replacing files already on disk (overrides -dedupe-across-runs); asks for confirmation first")
+	assumeYes            = flag.Bool("yes", false, "Answer yes to the confirmation asked before -force and -prune-confirm; required when not run from a terminal")
+	failFast             = flag.Bool("fail-fast", false, "Stop the run at the first failed download (skips are not failures) and exit with a nonzero code")
+	maxConsecutiveFails  = flag.Int("max-consecutive-failures", 0, "Abort the run after this many downloads in a row fail, as the origin is likely broken; 0 disables")
+	latestOnlyFlag       = flag.Bool("latest-only", false, "When a product page links several PDFs, download only the newest (by Last-Modified from a HEAD request, else the version in the filename)")
+	skipNewerThan        = flag.String("skip-newer-than", "", "Skip URLs whose local file was saved within this long (e.g. 24h, 7d) without any request, even with -force")
+	onlyMissing          = flag.Bool("only-missing", false, "Download only the extracted PDFs that are not yet on disk")
+	concurrency          = flag.String("concurrency", "1", "Number of PDFs downloaded in parallel, or auto to adapt to latency and errors (up to -max-concurrency)")
+	maxConcurrency       = flag.Int("max-concurrency", 8, "Most parallel downloads -concurrency auto ramps up to")
+	maxTotalBytes        = flag.String("max-total-bytes", "", "Stop starting new downloads once this much has been downloaded in the run (e.g. 500MB, 2GiB); the rest is written to pending.txt")
+	maxBandwidth         = flag.String("max-bandwidth", "", "Cap the combined download rate of all workers, in bytes per second (e.g. 2MB, 512KB); empty means unlimited")
+	filenameMode         = flag.String("filename-mode", "strict", "How much of a URL's filename is kept: strict (lowercase letters and digits, everything else becomes _) or relaxed (keeps case, dashes, dots and spaces; only characters filesystems refuse are replaced)")
+	sanitizerName        = flag.String("sanitizer", "default", "How filenames are derived from URLs: default, or sharepoint (also avoids Windows device names and caps names at 64 characters); builds on -filename-mode")
+	nameTemplate         = flag.String("name-template", "", "Filename template for saved PDFs, e.g. {product}_{date}_{hash}.pdf; placeholders: product, host, date (Last-Modified), hash (SHA-256 prefix). Full text/template syntax ({{.product}}) also works")
+	compressPDFs         = flag.Bool("compress", false, "Store each downloaded PDF gzipped as <name>.pdf.gz; existing .pdf.gz files count as already downloaded either way")
+	downloadImages       = flag.Bool("download-images", false, "Also save the JPEG, PNG and WebP product images on each product page into the images/ subdirectory")
+	extractZips          = flag.Bool("extract-zips", false, "Accept .zip bundles (linked or served in place of a PDF) and extract the PDFs inside them into the output directory")
+	removeZips           = flag.Bool("remove-zips", false, "With -extract-zips, delete each bundle after extracting it (it is then fetched again on the next run)")
+	downloadChunks       = flag.Int("chunks", 1, "Download large PDFs as N parallel byte ranges when the server supports it")
+	preferHTTPS          = flag.Bool("prefer-https", true, "Download http:// links on the NCL site over https://, falling back to http:// only if that fails")
+	mirrorHosts          = flag.String("mirrors", "", "Comma-separated alternate hosts (host, host:port or scheme://host) tried in order when the origin fails or returns 5xx")
+	maxRuntime           = flag.Duration("max-runtime", 0, "Stop the run after this long (e.g. 30m), cancelling in-flight downloads and writing the rest to pending.txt; 0 means no limit")
+	maxPages             = flag.Int("max-pages", 5000, "Stop scraping after fetching this many product pages, a guard against runaway -urls/-slugs lists; 0 means no limit")
+	maxRedirects         = flag.Int("max-redirects", 10, "Maximum redirects followed per request; redirect loops are always rejected")
+	proxyFlag            = flag.String("proxy", "", "Send all traffic through this proxy: http://, https://, socks5:// or socks5h://, with optional user:pass@ credentials (default: HTTP_PROXY/HTTPS_PROXY from the environment)")
+	ipVersion            = flag.String("ip-version", "auto", "Address family for connections: auto, 4 (IPv4 only) or 6 (IPv6 only)")
+	httpCacheDir         = flag.String("http-cache", "", "Cache scraped product pages in this directory so repeat runs skip the network; stale pages are revalidated with ETag/Last-Modified")
+	httpCacheTTL         = flag.Duration("http-cache-ttl", time.Hour, "How long cached pages stay fresh when the server sends no Cache-Control/Expires")
+	extractTimeout       = flag.Duration("extract-timeout", time.Minute, "Maximum time spent extracting PDF links from scraped HTML")
+	compareDir           = flag.String("compare-dir", "", "Instead of downloading, diff the output directory against this previous download set")
+	compareJSON          = flag.Bool("compare-json", false, "Print the -compare-dir report as JSON")
+	headDedupe           = flag.Bool("head-dedupe", false, "Send a HEAD before each download and skip URLs whose ETag (or Last-Modified and size) matches a saved file, recording them as aliases in the manifest")
+	traceRequests        = flag.Bool("trace", false, "Log DNS, connection, TLS and first-byte timings and the request and response headers of every request (see -trace-url)")
+	traceURL             = flag.String("trace-url", "", "Trace only requests for this URL, as -trace does for all of them")
+	fileModeFlag         = flag.String("file-mode", "0644", "Permissions (octal, before the umask) of the files created, e.g. 0664 for a group-writable archive")
+	dirModeFlag          = flag.String("dir-mode", "0755", "Permissions (octal, before the umask) of the directories created, e.g. 0775 for a group-writable archive")
+	contentRetries       = flag.Int("retry-on-content-mismatch", 0, "Retry a download up to this many times when the response is not a PDF (e.g. a cache served an HTML page first); 0 fails at once")
+	htmlMarkers          = flag.Bool("html-markers", true, "Wrap each page saved to nclonline.html in <!-- BEGIN url --> and <!-- END url --> comments")
+	languageFilter       = listFlag("language", "Only download documents whose filename marks this language (e.g. en), plus those that mark none (repeatable)")
+	languageMap          = flag.String("language-map", defaultLanguageMap, "Comma-separated word=language pairs naming the filename words that mark a document's language for -language, e.g. english=en,es=es")
+	partMaxAge           = flag.Duration("part-max-age", time.Hour, "At startup, remove .part files in the output directory older than this (empty documents are removed whatever their age)")
+	extractText          = flag.Bool("extract-text", false, "After each download, write the PDF's text to a .txt file next to it for full-text search (CPU-heavy; image-only PDFs are skipped with a warning)")
+	shuffle              = flag.Bool("shuffle", false, "Scrape product pages and download PDFs in random order instead of sorted order (with -max-pages, samples a different subset each run)")
+	shuffleSeed          = flag.Int64("seed", 0, "Seed for -shuffle, to repeat an order; 0 picks a new one and logs it")
+	archivePath          = flag.String("archive", "", "Write downloaded PDFs as entries of this .tar.gz, .tgz or .zip file instead of the output directory; entries already in it count as downloaded and are kept")
+	minTLS               = flag.String("min-tls", "1.2", "Lowest TLS version to negotiate for scrape and download traffic: 1.0, 1.1, 1.2 or 1.3")
+	pollInterval         = flag.Duration("poll", 0, "Keep running: repeat the whole scrape and download every interval (e.g. 6h), reporting changed documents after each cycle, until interrupted; 0 runs once. Combine with -no-skip-existing to check saved documents for changes")
+	parallelHash         = flag.Bool("parallel-hash", false, "Hash the files compared by -compare-dir on -concurrency workers at once (-max-concurrency with auto) instead of one at a time")
+	checkpointInterval   = flag.Int("checkpoint-interval", 25, "Write the download checkpoint after every N completed URLs")
+	resumeRun            = flag.Bool("resume", false, "Skip URLs recorded as completed in the checkpoint of an interrupted run")
+	soft404Markers       = listFlag("soft-404-marker", "Text (case-insensitive) that marks a 200 OK product page as a dead \"not found\" page, e.g. \"product not found\" (repeatable)")
+	categories           = listFlag("category", "Only fetch PDFs from product pages in this category, case-insensitive (repeatable)")
+	excludePatterns      = listFlag("exclude", "Skip PDFs whose filename or URL matches this glob pattern, case-insensitive (repeatable)")
+	excludeFile          = flag.String("exclude-file", "", "File of -exclude glob patterns, one per line, .gitignore style (# comments and blank lines ignored)")
+	seedCookies          = listFlag("cookie", "Cookie sent to the NCL site as name=value, seeded before the first request (repeatable)")
+	waitForLock          = flag.Bool("wait-for-lock", false, "If another run holds the output directory lock, wait for it instead of exiting")
+	summaryFile          = flag.String("summary-file", "", "Write the run summary as JSON to this file when the run ends, including stopped and failed runs")
+	webhookURL           = flag.String("webhook", "", "POST a JSON run summary to this URL (e.g. a Slack incoming webhook) when the run ends or fails")
+	healthCheck          = flag.Bool("health-check", false, "Before scraping, check that the site answers with the expected pages and abort if it does not")
+	healthCheckURLs      = flag.String("health-check-urls", "", "Comma-separated pages the -health-check fetches (default: the site index and the first product page)")
+	urlsFiles            = listFlag("urls", "File of product page URLs to scrape instead of the built-in list, one per line (# comments allowed); lines ending in .pdf are downloaded directly. Repeatable; the lists are merged, along with any named in NCL_URLS")
+	slugsFile            = flag.String("slugs", "", "File of product slugs (e.g. DUAL_BLEND_1), one per line, expanded to <base-url><product-path><slug> and scraped instead of the built-in list")
+	productPath          = flag.String("product-path", "/products/view/", "Path prefix -slugs are appended to")
+	exportURLs           = flag.String("export-urls", "", "Write the built-in product page list (sorted, deduplicated) to this file for use with -urls, then exit")
+	userAgentsFile       = flag.String("user-agents", "", "File with one User-Agent per line to rotate through round-robin (use responsibly; it is not a way around the site's terms)")
+	streamPages          = flag.Bool("stream-pages", false, "Extract links from product pages while they download instead of reading each page into memory first; product names and meta refreshes are not picked up")
+	expectedHashesFile   = flag.String("expected-hashes", "", "File of approved SHA-256 digests in sha256sum format (digest, then filename); downloads that don't match are reported as errors")
+	strictHashes         = flag.Bool("strict", false, "Exit nonzero when a download doesn't match its -expected-hashes digest, and refuse to start if any -expected-hashes line is malformed")
+)
+
+// Build metadata, set with -ldflags "-X main.version=v1.2.3 -X main.commit=abc1234 -X main.date=2006-01-02T15:04:05Z".
+// Values left empty are filled from the module and VCS information embedded by the Go toolchain.
+var version, commit, date string
+
+// Describes the build that is running, e.g. "v1.2.3 (commit abc1234, built 2006-01-02T15:04:05Z)"
+func versionString() string {
+	buildVersion, buildCommit, buildDate := version, commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if buildVersion == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			buildVersion = info.Main.Version
+		}
+		vcsCommit, dirty := "", false
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				vcsCommit = setting.Value[:min(12, len(setting.Value))] // Short hash
+			case "vcs.modified":
+				dirty = setting.Value == "true"
+			case "vcs.time":
+				if buildDate == "" {
+					buildDate = setting.Value
+				}
+			}
+		}
+		if buildCommit == "" && vcsCommit != "" {
+			buildCommit = vcsCommit
+			if dirty { // Built from a tree with uncommitted changes
+				buildCommit += "-dirty"
+			}
+		}
+	}
+	if buildVersion == "" {
+		buildVersion = "dev"
+	}
+	if buildCommit == "" {
+		buildCommit = "unknown"
+	}
+	if buildDate == "" {
+		buildDate = "unknown"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s)", buildVersion, buildCommit, buildDate)
+}
+
+// When the run started; used for the elapsed time in the summary
+var startTime = time.Now()
+
+// Origin the product pages and relative PDF links belong to
+const defaultBaseURL = "https://www.nclonline.com"
+
+// Site the product pages and relative PDF links are resolved against; set by -base-url
+var baseURL = defaultBaseURL
+
+// Name of the manifest kept in the output directory
+const manifestFilename = "manifest.json"
+
+// Name of the browsable report kept in the output directory
+const reportFilename = "index.html"
+
+// Name of the PDF-to-product-page report kept in the output directory
+const referencesFilename = "references.json"
+
+// Number of times a request is repeated after 429 Too Many Requests
+const max429Retries = 3
+
+// Run-wide allowance of extra attempts (429 retries, mirror failovers and
+// -retry-on-content-mismatch retries), shared by all workers. The http fallback
+// after a failed -prefer-https upgrade is not counted.
+type retryBudget struct {
+	limit int64        // Most retries allowed; 0 means unlimited
+	used  atomic.Int64 // Retries taken so far
+}
+
+// Takes one retry from the budget; false once it is used up
+func (budget *retryBudget) take() bool {
+	for {
+		used := budget.used.Load()
+		if budget.limit > 0 && used >= budget.limit {
+			return false
+		}
+		if budget.used.CompareAndSwap(used, used+1) {
+			return true
+		}
+	}
+}
+
+// Retries spent this run; the limit is set by -retry-budget
+var retries retryBudget
+
+// Wait used when a 429 response has no usable Retry-After header
+const defaultRetryAfter = 5 * time.Second
+
+// Subdirectory of the output directory holding -download-images files
+const imagesDirname = "images"
+
+// Name of the list of URLs left over when a run stops early
+const pendingFilename = "pending.txt"
+
+// Name of the lockfile that keeps two runs from writing the output directory at once
+const lockFilename = ".lock"
+
+// Cause given when -fail-fast stops the downloads
+var errFailFast = errors.New("stopped at the first failed download (-fail-fast)")
+
+// Cause given when -max-consecutive-failures stops the downloads
+var errOriginBroken = errors.New("origin appears broken (-max-consecutive-failures reached)")
+
+// Reason recorded when -max-total-bytes stops new downloads
+var errByteCapReached = errors.New("-max-total-bytes reached")
+
+// Bytes of document content received this run, shared by all workers
+var totalBytes atomic.Int64
+
+// Parsed -max-total-bytes; 0 means no cap
+var byteCap int64
+
+// Exit codes: 0 means every URL was downloaded or skipped
+const (
+	exitFailures  = 1 // Some downloads failed
+	exitFatal     = 2 // Setup failed, e.g. bad flags or an unwritable output directory
+	exitCancelled = 3 // The run was interrupted or hit -max-runtime before finishing
+)
+
+// Environment variable naming more -urls lists, separated like PATH, for list files
+// a scheduler or deployment provides without editing the command line
+const urlsEnv = "NCL_URLS"
+
+// Merges the -urls lists with those in NCL_URLS: command-line lists first, so a URL
+// both name is attributed to the command-line list, and each file only once
+func urlListFiles(flagged []string, env string) []string {
+	var files []string
+	for _, file := range slices.Concat(flagged, filepath.SplitList(env)) {
+		if file != "" && !slices.Contains(files, file) {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// Prints the flag help followed by the environment variables and exit codes
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), `
+Environment:
+  %s  more -urls lists, separated by %q; merged after those on the command line
+
+Exit codes:
+  0  all URLs were downloaded or skipped
+  %d  some downloads failed
+  %d  fatal setup error (bad flags, unwritable output directory, ...)
+  %d  cancelled or timed out (remaining URLs are in %s)
+`, urlsEnv, filepath.ListSeparator, exitFailures, exitFatal, exitCancelled, pendingFilename)
+}
+
+// Files smaller than this are always downloaded as a single stream
+const minChunkedSize = 4 << 20
+
+// User-Agent sent when no rotation pool is configured
+const defaultUserAgent = "nclonline-com-documentation (+https://github.com/Strong-Foundation/nclonline-com-documentation)"
+
+// Client main configures and hands to the Downloader for all scrape and download
+// traffic; fatal also posts its -webhook notification through it
+var httpClient = newHTTPClient()
+
+// Creates the production HTTP client. Scraping used to go through http.DefaultClient
+// and downloads through their own client with a 15-minute timeout; both now share
+// this one so that settings apply to all traffic alike: the cookie jar carries
+// cookies set while scraping (e.g. an "accept terms" gate) over to the download
+// requests, CheckRedirect enforces -max-redirects, and the transport takes -proxy,
+// -ip-version and -min-tls. Page fetches thereby also get the 15-minute timeout.
+func newHTTPClient() *http.Client {
+	jar, _ := cookiejar.New(nil) // Never fails without options
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	return &http.Client{Timeout: 15 * time.Minute, Jar: jar, Transport: transport, CheckRedirect: checkRedirect}
+}
+
+// Stops redirect chains that revisit a URL or exceed -max-redirects, logging the chain
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	var chain []string
+	for _, previous := range via {
+		chain = append(chain, previous.URL.String())
+	}
+	chain = append(chain, req.URL.String())
+	for _, previous := range via {
+		if previous.URL.String() == req.URL.String() {
+			logf(req.Context(), "Redirect loop: %s", strings.Join(chain, " → "))
+			return fmt.Errorf("redirect loop back to %s", req.URL)
+		}
+	}
+	if len(via) > *maxRedirects {
+		logf(req.Context(), "Too many redirects: %s", strings.Join(chain, " → "))
+		return fmt.Errorf("stopped after %d redirects", *maxRedirects)
+	}
+	return nil
+}
+
+// Returns the client's transport for configuration, or nil if it has been replaced
+func sharedTransport(client *http.Client) *http.Transport {
+	transport, _ := client.Transport.(*http.Transport)
+	return transport
+}
+
+// Maps an -ip-version value to the network name used for dialing
+func dialNetwork(version string) (string, error) {
+	switch version {
+	case "auto":
+		return "tcp", nil // Let the resolver and Happy Eyeballs pick
+	case "4":
+		return "tcp4", nil
+	case "6":
+		return "tcp6", nil
+	}
+	return "", fmt.Errorf("invalid -ip-version %q (expected auto, 4 or 6)", version)
+}
+
+// Forces the transport to dial only the given network (tcp4 or tcp6)
+func restrictAddressFamily(transport *http.Transport, network string) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second} // Same settings as the default transport
+	transport.DialContext = func(ctx context.Context, _ string, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}
+}
+
+// TLS versions accepted by -min-tls
+var tlsVersions = map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// Makes the transport refuse servers that only offer TLS versions below minimum
+func requireTLSVersion(transport *http.Transport, minimum uint16) {
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.MinVersion = minimum
+}
+
+// Routes all traffic through the -proxy URL. http:// and https:// proxies use the
+// transport's own proxy support; socks5:// and socks5h:// dial through
+// golang.org/x/net/proxy. Credentials are taken from the URL (user:pass@host:port).
+func configureProxy(transport *http.Transport, rawURL string) error {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid -proxy: %w", err)
+	}
+	if proxyURL.Hostname() == "" {
+		return fmt.Errorf("invalid -proxy %q: no host", proxyURL.Redacted())
+	}
+	switch proxyURL.Scheme {
+	case "http", "https":
+		transport.Proxy = http.ProxyURL(proxyURL) // Sends Proxy-Authorization from the user info
+	case "socks5", "socks5h":
+		forward := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second} // Connects to the proxy itself
+		dialer, err := proxy.FromURL(proxyURL, forward)
+		if err != nil {
+			return fmt.Errorf("invalid -proxy: %w", err)
+		}
+		contextDialer, ok := dialer.(proxy.ContextDialer)
+		if !ok {
+			return fmt.Errorf("invalid -proxy %q: dialer does not support contexts", proxyURL.Redacted())
+		}
+		transport.Proxy = nil // HTTP_PROXY and friends would otherwise be tried on top
+		transport.DialContext = contextDialer.DialContext
+	default:
+		return fmt.Errorf("invalid -proxy %q (expected an http, https, socks5 or socks5h URL)", proxyURL.Redacted())
+	}
+	log.Printf("Using proxy %s", proxyURL.Redacted())
+	return nil
+}
+
+var (
+	userAgents     = []string{defaultUserAgent} // Pool of User-Agents used for outgoing requests
+	userAgentIndex atomic.Uint64                // Round-robin position in the pool
 )
 
+// Key under which a worker ID is stored in a context
+type workerIDKey struct{}
+
+// Returns a context whose log records are attributed to the given worker
+func withWorkerID(ctx context.Context, id int) context.Context {
+	return context.WithValue(ctx, workerIDKey{}, id)
+}
+
+// Logs one record, prefixed with the worker ID carried by ctx when there is one.
+// The standard logger writes each record with a single locked write, so records
+// from concurrent workers never interleave.
+func logf(ctx context.Context, format string, args ...any) {
+	if id, ok := ctx.Value(workerIDKey{}).(int); ok {
+		format = fmt.Sprintf("[worker %d] ", id) + format
+	}
+	log.Printf(format, args...)
+}
+
+// Logs a message only when running with -log-level=debug
+func debugf(ctx context.Context, format string, args ...any) {
+	if *logLevel == "debug" {
+		logf(ctx, "DEBUG "+format, args...)
+	}
+}
+
 // It checks if the file exists
 // If the file exists, it returns true
 // If the file does not exist, it returns false
@@ -32,23 +489,133 @@ func removeFile(path string) {
 	}
 }
 
-// extractPDFUrls takes an HTML string and returns all .pdf URLs in a slice
-func extractPDFUrls(htmlContent string) []string {
-	// Compile a regex pattern that looks for href="...something.pdf"
-	regexPattern := regexp.MustCompile(`href="([^"]+\.pdf)"`)
+// Matches a quoted attribute value together with the = before it
+var attributeValuePattern = regexp.MustCompile(`=\s*("[^"]*"|'[^']*')`)
 
-	// Find all matches in the input string; each match is a slice of groups
-	matches := regexPattern.FindAllStringSubmatch(htmlContent, -1)
+// Matches a line break and the indentation around it
+var lineBreakPattern = regexp.MustCompile(`[ \t]*\r?\n[ \t]*`)
+
+// Cleans up stray whitespace in attribute values, e.g. href="/sds/\n   FOO.pdf ",
+// so the values compare cleanly. Only start tags are rewritten; text, comments and
+// script content, which may hold "= '...'" of their own, are left as is.
+func normalizeHTML(s string) string {
+	var normalized strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tokenType := tokenizer.Next()
+		raw := string(tokenizer.Raw()) // Only valid until the next call to Next
+		if tokenType == html.StartTagToken || tokenType == html.SelfClosingTagToken {
+			raw = attributeValuePattern.ReplaceAllStringFunc(raw, func(match string) string {
+				value := match[strings.IndexAny(match, `"'`):] // Quoted value, quotes included
+				quote := value[:1]
+				inner := value[1 : len(value)-1]
+				inner = strings.TrimSpace(lineBreakPattern.ReplaceAllString(inner, ""))
+				return "=" + quote + inner + quote
+			})
+		}
+		normalized.WriteString(raw)
+		if tokenType == html.ErrorToken { // End of document
+			return normalized.String()
+		}
+	}
+}
+
+// Matches window.open('...pdf'), location.href = "...pdf" and location = '...pdf' in inline JavaScript.
+// The assignment is a single = followed only by spaces and the quoted value, so comparisons
+// such as location == '...pdf' or location.href !== "...pdf" never match, nor do names
+// that merely end in "location" (allocation = '...pdf').
+var scriptPDFPattern = regexp.MustCompile(`(?:\bwindow\.open\s*\(|\blocation(?:\.href)?\s*=)\s*['"]([^'"]+\.pdf)['"]`)
+
+// Returns the PDF links named in a piece of inline JavaScript
+func scriptPDFLinks(script string) []string {
+	var links []string
+	for _, match := range scriptPDFPattern.FindAllStringSubmatch(script, -1) {
+		links = append(links, match[1])
+	}
+	return links
+}
+
+// Checks whether a link points at a document: a PDF, or a zip bundle with -extract-zips.
+// The extension is matched on the path in any case, so query strings such as
+// ?utm_source=x (removed later by -strip-params) and fragments don't hide it.
+func isDocumentLink(link string) bool {
+	parsed, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return false
+	}
+	extension := strings.ToLower(path.Ext(parsed.Path))
+	return extension == ".pdf" || *extractZips && extension == ".zip"
+}
+
+// Elements that show a document inline, with the attribute holding its URL
+var embeddedSourceAttributes = map[string]string{
+	"iframe": "src",
+	"embed":  "src",
+	"object": "data",
+}
+
+// extractPDFUrls parses an HTML string and returns all .pdf link targets in a slice.
+// Parsing stops early, returning what was found so far, when the context is cancelled.
+func extractPDFUrls(ctx context.Context, htmlContent string) []string {
+	return extractPDFUrlsFrom(ctx, strings.NewReader(htmlContent))
+}
+
+// extractPDFUrlsFrom is extractPDFUrls for a stream: links are collected as the
+// document is read, so it never has to be held in memory as a whole.
+func extractPDFUrlsFrom(ctx context.Context, reader io.Reader) []string {
+	// Tokenize the HTML rather than pattern-matching the raw text
+	tokenizer := html.NewTokenizer(reader)
 
 	// Slice to store the extracted PDF URLs
 	var pdfURLs []string
+	// Whether the tokenizer is inside a <script> element
+	inScript := false
+
+	// Walk every token until the end of the document
+	for {
+		select {
+		case <-ctx.Done(): // Bail out on pathological pages instead of hanging
+			log.Printf("PDF extraction stopped early after %d link(s): %v", len(pdfURLs), ctx.Err())
+			return pdfURLs
+		default:
+		}
+
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken { // io.EOF or a malformed document ends parsing
+			break
+		}
+		if *aggressiveExtract && tokenType == html.TextToken && inScript { // Links opened from script blocks
+			pdfURLs = append(pdfURLs, scriptPDFLinks(string(tokenizer.Text()))...)
+			continue
+		}
+		if tokenType == html.EndTagToken {
+			if name, _ := tokenizer.TagName(); string(name) == "script" {
+				inScript = false
+			}
+			continue
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
 
-	// Loop through all regex matches
-	for _, match := range matches {
-		// match[0] is the whole string, match[1] is the captured group (the actual URL)
-		if len(match) > 1 {
-			// Append the URL to our slice
-			pdfURLs = append(pdfURLs, match[1])
+		token := tokenizer.Token()
+		if token.Data == "script" && tokenType == html.StartTagToken {
+			inScript = true
+		}
+		// Look for href="...something.pdf" on any element
+		for _, attribute := range token.Attr {
+			if attribute.Key == "href" && isDocumentLink(attribute.Val) {
+				// Append the URL to our slice
+				pdfURLs = append(pdfURLs, attribute.Val)
+			} else if embeddedSourceAttributes[token.Data] == attribute.Key && isDocumentLink(attribute.Val) { // Shown inline by a viewer
+				pdfURLs = append(pdfURLs, attribute.Val)
+			} else if !*aggressiveExtract {
+				continue
+			} else if strings.HasPrefix(attribute.Key, "data-") && isDocumentLink(attribute.Val) { // e.g. data-href
+				pdfURLs = append(pdfURLs, attribute.Val)
+			} else if strings.HasPrefix(attribute.Key, "on") { // e.g. onclick="window.open('...pdf')"
+				pdfURLs = append(pdfURLs, scriptPDFLinks(attribute.Val)...)
+			}
 		}
 	}
 
@@ -56,6 +623,169 @@ func extractPDFUrls(htmlContent string) []string {
 	return pdfURLs
 }
 
+// Descriptive fields scraped from a product page
+type productMetadata struct {
+	Name     string `json:"name"`     // Product name from the page heading or title
+	Category string `json:"category"` // Product category, when the page states one
+}
+
+// Returns the value of an attribute on a token, or "" when absent
+func attributeValue(token html.Token, key string) string {
+	for _, attribute := range token.Attr {
+		if attribute.Key == key {
+			return attribute.Val
+		}
+	}
+	return ""
+}
+
+// Image extensions archived by -download-images, with the content types accepted for them
+var imageTypes = map[string][]string{
+	".jpg":  {"image/jpeg"},
+	".jpeg": {"image/jpeg"},
+	".png":  {"image/png"},
+	".webp": {"image/webp"},
+}
+
+// Returns the extension of an image URL archived by -download-images, or ""
+func imageExtension(link string) string {
+	if parsed, err := url.Parse(strings.TrimSpace(link)); err == nil {
+		link = parsed.Path // Ignore query strings such as ?v=2
+	}
+	extension := strings.ToLower(path.Ext(link))
+	if _, found := imageTypes[extension]; !found {
+		return ""
+	}
+	return extension
+}
+
+// Returns the src of every <img> on a page that points to a JPEG, PNG or WebP file
+func extractImageURLs(htmlContent string) []string {
+	tokenizer := html.NewTokenizer(strings.NewReader(htmlContent))
+	var images []string
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken { // End of the document
+			return images
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		if src := attributeValue(token, "src"); token.Data == "img" && imageExtension(src) != "" && !slices.Contains(images, src) {
+			images = append(images, src)
+		}
+	}
+}
+
+// Most <meta http-equiv="refresh"> hops followed from one product page
+const maxMetaRefreshes = 3
+
+// Content of a meta refresh tag, e.g. "0; url=/products/view/X" (the URL may be quoted)
+var metaRefreshPattern = regexp.MustCompile(`(?i)^\s*[\d.]*\s*[;,]\s*url\s*=\s*['"]?([^'"]+)`)
+
+// Returns the target of a page's <meta http-equiv="refresh"> tag, or "" when it has none
+func metaRefreshTarget(htmlContent string) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(htmlContent))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken: // End of the document
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data != "meta" || !strings.EqualFold(attributeValue(token, "http-equiv"), "refresh") {
+				continue
+			}
+			if match := metaRefreshPattern.FindStringSubmatch(attributeValue(token, "content")); match != nil {
+				return strings.TrimSpace(match[1])
+			}
+		}
+	}
+}
+
+// Follows interstitial pages that redirect with a meta refresh, which the HTTP client
+// does not do, up to maxMetaRefreshes hops and never revisiting a page. Returns the
+// URL and content of the last page fetched, or the error from a hop that could not be fetched.
+func (downloader *Downloader) followMetaRefresh(ctx context.Context, pageURL string, content string) (string, string, error) {
+	visited := map[string]bool{pageURL: true}
+	for hops := 0; ; hops++ {
+		target := metaRefreshTarget(content)
+		if target == "" {
+			return pageURL, content, nil
+		}
+		next := resolvePDFURL(pageURL, target)
+		if visited[next] || !isUrlValid(next) {
+			logf(ctx, "Ignoring meta refresh from %s to %s", pageURL, next)
+			return pageURL, content, nil
+		}
+		if hops == maxMetaRefreshes {
+			logf(ctx, "Not following meta refresh from %s: more than %d hops", pageURL, maxMetaRefreshes)
+			return pageURL, content, nil
+		}
+		logf(ctx, "Following meta refresh from %s to %s", pageURL, next)
+		visited[next] = true
+		var err error
+		pageURL = next
+		if content, err = downloader.getDataFromURL(ctx, next); err != nil {
+			return pageURL, content, err
+		}
+	}
+}
+
+// Extracts the product name (first <h1>, falling back to <title>) and category
+// (<meta name="category"> or the first element with "category" in its class) from a page
+func extractProductMetadata(htmlContent string) productMetadata {
+	var metadata productMetadata
+	var title string
+	tokenizer := html.NewTokenizer(strings.NewReader(htmlContent))
+	var field *string  // Field that text is currently being collected into
+	var closing string // Tag that ends the current collection
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken: // End of document
+			if metadata.Name == "" {
+				metadata.Name = title
+			}
+			return metadata
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if field != nil {
+				continue
+			}
+			switch {
+			case token.Data == "title" && title == "":
+				field, closing = &title, token.Data
+			case token.Data == "h1" && metadata.Name == "":
+				field, closing = &metadata.Name, token.Data
+			case token.Data == "meta" && attributeValue(token, "name") == "category" && metadata.Category == "":
+				metadata.Category = strings.TrimSpace(attributeValue(token, "content"))
+			case tokenType == html.StartTagToken && metadata.Category == "" && strings.Contains(attributeValue(token, "class"), "category"):
+				field, closing = &metadata.Category, token.Data
+			}
+		case html.TextToken:
+			if field != nil {
+				*field += string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			if field != nil && tokenizer.Token().Data == closing {
+				*field = strings.Join(strings.Fields(*field), " ") // Collapse markup whitespace
+				field = nil
+			}
+		}
+	}
+}
+
+// Reports whether a category matches any of the wanted ones, ignoring case
+func matchesCategory(category string, wanted []string) bool {
+	for _, candidate := range wanted {
+		if strings.EqualFold(strings.TrimSpace(candidate), category) {
+			return true
+		}
+	}
+	return false
+}
+
 // Checks whether a given directory exists
 func directoryExists(path string) bool {
 	directory, err := os.Stat(path) // Get info for the path
@@ -65,42 +795,211 @@ func directoryExists(path string) bool {
 	return directory.IsDir() // Return true if it's a directory
 }
 
-// Creates a directory at given path with provided permissions
+// Permissions for the files and directories the tool creates, before the umask; set by -file-mode and -dir-mode
+var (
+	fileMode os.FileMode = 0o644
+	dirMode  os.FileMode = 0o755
+)
+
+// Parses an octal permission value such as 0664 or 775
+func parsePermissions(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(strings.TrimPrefix(value, "0o"), 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("%q is not an octal permission between 0 and 0777", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Creates a directory at given path, and any missing parents, with provided permissions
 func createDirectory(path string, permission os.FileMode) {
-	err := os.Mkdir(path, permission) // Attempt to create directory
+	err := os.MkdirAll(path, permission) // Attempt to create directory
 	if err != nil {
 		log.Println(err) // Log error if creation fails
 	}
 }
 
-// Verifies whether a string is a valid URL format
+// Creates the output directory if needed, following a symlink to it, and explains
+// the cases where it can't be used
+func prepareOutputDirectory(path string) error {
+	if err := os.MkdirAll(path, dirMode); err == nil {
+		return nil
+	}
+	info, err := os.Lstat(filepath.Clean(path))
+	if err != nil { // A parent is missing or unusable
+		return fmt.Errorf("cannot create output directory %s: %w", path, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 { // MkdirAll follows working symlinks, so this one is broken or points at a file
+		target, _ := os.Readlink(filepath.Clean(path))
+		return fmt.Errorf("output directory %s is a symlink to %s, which is not a directory", path, target)
+	}
+	return fmt.Errorf("output directory %s exists but is not a directory", path)
+}
+
+// Removes zero-byte documents and .part files older than partMaxAge from the output
+// directory and its images/ subdirectory. Both are left by crashed runs, and an empty
+// file would otherwise count as already downloaded. Runs under the lock, so no other
+// run is writing them.
+func cleanupLeftovers(outputDir string, partMaxAge time.Duration) {
+	for _, directory := range []string{outputDir, filepath.Join(outputDir, imagesDirname)} {
+		entries, err := os.ReadDir(directory)
+		if err != nil {
+			continue // images/ only exists with -download-images
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || isBookkeepingFile(entry.Name()) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			path := filepath.Join(directory, entry.Name())
+			if strings.HasSuffix(entry.Name(), ".part") {
+				if age := time.Since(info.ModTime()); age >= partMaxAge {
+					log.Printf("Removing stale partial download %s (%s old)", path, age.Round(time.Second))
+					removeFile(path)
+				}
+			} else if info.Size() == 0 {
+				log.Printf("Removing empty file %s", path)
+				removeFile(path)
+			}
+		}
+	}
+}
+
+// Fails unless a file can be created in a directory, so a read-only output directory
+// is reported before scraping rather than on every download
+func checkWritable(path string) error {
+	probe, err := os.CreateTemp(path, ".write-test-*")
+	if err != nil {
+		return fmt.Errorf("output directory %s is not writable: %w", path, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Verifies whether a string is an absolute http(s) URL with a host. ParseRequestURI
+// alone also accepts "http://", "mailto:..." and scheme-relative "//host/x.pdf".
 func isUrlValid(uri string) bool {
-	_, err := url.ParseRequestURI(uri) // Try parsing the URL
-	return err == nil                  // Return true if valid
+	parsed, err := url.ParseRequestURI(uri) // Try parsing the URL
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
 }
 
-// Removes duplicate strings from a slice
+// Removes duplicate URLs from a slice, keeping the first spelling of each.
+// URLs that differ only in host case, a trailing slash or a fragment count as duplicates.
 func removeDuplicatesFromSlice(slice []string) []string {
 	check := make(map[string]bool) // Map to track seen values
 	var newReturnSlice []string    // Slice to store unique values
 	for _, content := range slice {
-		if !check[content] { // If not already seen
-			check[content] = true                            // Mark as seen
+		key := normalizePageURL(content)
+		if !check[key] { // If not already seen
+			check[key] = true                                // Mark as seen
 			newReturnSlice = append(newReturnSlice, content) // Add to result
 		}
 	}
 	return newReturnSlice
 }
 
-// hasDomain checks if the given string has a domain (host part)
-func hasDomain(rawURL string) bool {
-	// Try parsing the raw string as a URL
+// Reduces a page URL to the form used to spot duplicates: scheme and host are
+// lowercased and the fragment and trailing slash dropped. Paths keep their case.
+func normalizePageURL(rawURL string) string {
+	trimmed := strings.TrimSpace(rawURL)
+	parsed, err := url.Parse(trimmed)
+	if err != nil || parsed.Host == "" {
+		return strings.TrimSuffix(trimmed, "/")
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	parsed.Fragment = ""
+	parsed.RawFragment = ""
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+	parsed.RawPath = strings.TrimSuffix(parsed.RawPath, "/")
+	return parsed.String()
+}
+
+// Turns a link found on a page into an absolute URL. Relative links resolve against
+// the page they appear on, so pages in any section of the site (/products/view/...,
+// /products/flyer_alpha.php, ...) work the same way.
+func resolvePDFURL(pageURL string, link string) string {
+	page, err := url.Parse(pageURL)
+	if err != nil || page.Host == "" { // No usable page URL; resolve against the site root
+		page, _ = url.Parse(baseURL + "/") // Always parses; checked by parseBaseURL
+	}
+	reference, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return link // Left for isUrlValid to reject
+	}
+	return rebaseURL(page.ResolveReference(reference).String())
+}
+
+// Moves a URL on the NCL site onto -base-url; other hosts are left alone
+func rebaseURL(rawURL string) string {
+	if baseURL == defaultBaseURL {
+		return rawURL
+	}
 	parsed, err := url.Parse(rawURL)
-	if err != nil { // If parsing fails, it's not a valid URL
-		return false
+	if err != nil || !strings.EqualFold(parsed.Hostname(), siteHostname()) {
+		return rawURL
+	}
+	rebased, err := rewriteHost(rawURL, baseURL)
+	if err != nil {
+		return rawURL
+	}
+	return rebased
+}
+
+// Returns the host name of the real NCL site
+func siteHostname() string {
+	parsed, _ := url.Parse(defaultBaseURL) // A constant that always parses
+	return parsed.Hostname()
+}
+
+// Checks a -base-url value and returns its scheme and host
+func parseBaseURL(value string) (string, error) {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid -base-url %q: %w", value, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return "", fmt.Errorf("invalid -base-url %q (expected http(s)://host[:port])", value)
+	}
+	return parsed.Scheme + "://" + parsed.Host, nil
+}
+
+// Splits a comma-separated flag value into trimmed, non-empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Removes query parameters whose names match any of the glob patterns (e.g. utm_*)
+func stripTrackingParams(rawURL string, patterns []string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.RawQuery == "" {
+		return rawURL
 	}
-	// If the parsed URL has a non-empty Host, then it has a domain/host
-	return parsed.Host != ""
+	query := parsed.Query()
+	stripped := false
+	for key := range query {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, key); matched {
+				query.Del(key)
+				stripped = true
+				break
+			}
+		}
+	}
+	if !stripped { // Leave untouched URLs exactly as they were
+		return rawURL
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
 }
 
 // Extracts filename from full path (e.g. "/dir/file.pdf" → "file.pdf")
@@ -119,6 +1018,53 @@ func getFileExtension(path string) string {
 	return filepath.Ext(path) // Extract and return file extension
 }
 
+// Turns a document URL (or a server-provided filename) into the name it is saved under
+type Sanitizer func(rawURL string) string
+
+// Filename sanitizers selectable with -sanitizer, each built on the -filename-mode conversion
+var sanitizers = map[string]func(base Sanitizer) Sanitizer{
+	"default":    func(base Sanitizer) Sanitizer { return base },
+	"sharepoint": sharepointFilename,
+}
+
+// URL-to-filename conversions selectable with -filename-mode, which the sanitizers build on
+var filenameModes = map[string]Sanitizer{
+	"strict":  urlToFilename,
+	"relaxed": relaxedFilename,
+}
+
+// Fetches documents and images and decides the names they are saved under. One
+// is built in main from the flags; tests build their own with a test server's
+// client and whichever sanitizer they exercise.
+type Downloader struct {
+	Client    *http.Client // Sends every page, document, image and HEAD request
+	Sanitizer Sanitizer    // Names every saved, skipped and pruned file
+}
+
+// Longest filename the sharepoint sanitizer produces, including ".pdf"
+const sharepointFilenameLength = 64
+
+// Device names Windows (and so SharePoint and OneDrive) refuse as filenames
+var reservedFilenames = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])$`)
+
+// Like base, for targets with tight naming rules such as SharePoint: reserved
+// device names get a suffix and long names are cut to sharepointFilenameLength,
+// kept distinct by a hash of the URL.
+func sharepointFilename(base Sanitizer) Sanitizer {
+	return func(rawURL string) string {
+		stem := strings.TrimSuffix(base(rawURL), ".pdf")
+		if reservedFilenames.MatchString(stem) {
+			stem += "_file"
+		}
+		if len(stem)+len(".pdf") > sharepointFilenameLength {
+			digest := sha256.Sum256([]byte(rawURL))
+			suffix := "_" + hex.EncodeToString(digest[:4])
+			stem = strings.TrimRight(stem[:sharepointFilenameLength-len(".pdf")-len(suffix)], "_") + suffix
+		}
+		return stem + ".pdf"
+	}
+}
+
 // Converts a raw URL into a sanitized PDF filename safe for filesystem
 func urlToFilename(rawURL string) string {
 	lower := strings.ToLower(rawURL) // Convert URL to lowercase
@@ -137,6 +1083,9 @@ func urlToFilename(rawURL string) string {
 	for _, invalidPre := range invalidSubstrings { // Remove unwanted substrings
 		safe = removeSubstring(safe, invalidPre)
 	}
+	if safe == "" { // Nothing usable in the name, e.g. "---"
+		safe = unnamedFilename(rawURL)
+	}
 
 	if getFileExtension(safe) != ".pdf" { // Ensure file ends with .pdf
 		safe = safe + ".pdf"
@@ -145,86 +1094,3209 @@ func urlToFilename(rawURL string) string {
 	return safe // Return sanitized filename
 }
 
-// Downloads a PDF from given URL and saves it in the specified directory
-func downloadPDF(finalURL, outputDir string) bool {
-	filename := strings.ToLower(urlToFilename(finalURL)) // Sanitize the filename
-	filePath := filepath.Join(outputDir, filename)       // Construct full path for output file
-
-	if fileExists(filePath) { // Skip if file already exists
-		log.Printf("File already exists, skipping: %s", filePath)
-		return false
-	}
+// Stem for a URL whose name has nothing usable in it, kept distinct by a hash of the URL
+func unnamedFilename(rawURL string) string {
+	digest := sha256.Sum256([]byte(rawURL))
+	return "document_" + hex.EncodeToString(digest[:4])
+}
 
-	client := &http.Client{Timeout: 15 * time.Minute} // Create HTTP client with timeout
+// Characters filesystems refuse in a name: path separators, those Windows reserves, and control characters
+var illegalFilenameChars = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f\x7f]`)
 
-	resp, err := client.Get(finalURL) // Send HTTP GET request
-	if err != nil {
-		log.Printf("Failed to download %s: %v", finalURL, err)
-		return false
+// Like urlToFilename, but only replaces the characters a filesystem refuses, keeping
+// case, dashes, dots and spaces so names that differ only in punctuation stay distinct
+func relaxedFilename(rawURL string) string {
+	name := path.Base(strings.ReplaceAll(rawURL, "\\", "/"))               // Last segment only
+	if parsed, err := url.Parse(rawURL); err == nil && parsed.Host != "" { // A URL: its last path segment, without the query string
+		name = path.Base(parsed.EscapedPath())
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
 	}
-	defer resp.Body.Close() // Ensure response body is closed
-
-	if resp.StatusCode != http.StatusOK { // Check if response is 200 OK
-		log.Printf("Download failed for %s: %s", finalURL, resp.Status)
-		return false
+	safe := illegalFilenameChars.ReplaceAllString(name, "_")               // Replace what no filesystem accepts
+	safe = strings.Trim(safe, ". ")                                        // No hidden files; Windows drops trailing dots and spaces
+	if extension := path.Ext(safe); strings.EqualFold(extension, ".pdf") { // One spelling of the extension
+		safe = strings.TrimSuffix(safe, extension)
 	}
-
-	contentType := resp.Header.Get("Content-Type")                                                                  // Get content type of response
-	if !strings.Contains(contentType, "binary/octet-stream") && !strings.Contains(contentType, "application/pdf") { // Check if it's a PDF
-		log.Printf("Invalid content type for %s: %s (expected binary/octet-stream) (expected application/pdf)", finalURL, contentType)
-		return false
+	if strings.Trim(safe, "_. ") == "" { // Nothing usable, e.g. a bare host or a trailing "/"
+		safe = unnamedFilename(rawURL)
 	}
+	return safe + ".pdf"
+}
 
-	var buf bytes.Buffer                     // Create a buffer to hold response data
-	written, err := io.Copy(&buf, resp.Body) // Copy data into buffer
+// Returns the URL with its host replaced by a mirror, keeping the path and query.
+// A mirror given with a scheme (https://host) also replaces the scheme.
+func rewriteHost(rawURL string, mirror string) (string, error) {
+	parsed, err := url.Parse(rawURL)
 	if err != nil {
-		log.Printf("Failed to read PDF data from %s: %v", finalURL, err)
-		return false
+		return "", err
 	}
-	if written == 0 { // Skip empty files
-		log.Printf("Downloaded 0 bytes for %s; not creating file", finalURL)
-		return false
+	if strings.Contains(mirror, "://") {
+		mirrorURL, err := url.Parse(mirror)
+		if err != nil {
+			return "", err
+		}
+		parsed.Scheme = mirrorURL.Scheme
+		parsed.Host = mirrorURL.Host
+	} else {
+		parsed.Host = mirror
 	}
+	return parsed.String(), nil
+}
 
-	out, err := os.Create(filePath) // Create output file
-	if err != nil {
-		log.Printf("Failed to create file for %s: %v", finalURL, err)
-		return false
+// Lists the URL followed by its equivalents on each configured mirror
+func mirrorCandidates(ctx context.Context, rawURL string) []string {
+	candidates := []string{rawURL}
+	for _, mirror := range splitList(*mirrorHosts) {
+		rewritten, err := rewriteHost(rawURL, mirror)
+		if err != nil {
+			logf(ctx, "Ignoring invalid mirror %q: %v", mirror, err)
+			continue
+		}
+		candidates = append(candidates, rewritten)
 	}
-	defer out.Close() // Ensure file is closed after writing
+	return candidates
+}
 
-	if _, err := buf.WriteTo(out); err != nil { // Write buffer contents to file
-		log.Printf("Failed to write PDF to file for %s: %v", finalURL, err)
-		return false
+// Returns the https:// form of an http:// link on the NCL site when -prefer-https
+// is on; any other URL is returned unchanged
+func upgradeToHTTPS(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if !*preferHTTPS || err != nil || parsed.Scheme != "http" || !strings.EqualFold(parsed.Hostname(), siteHostname()) {
+		return rawURL
 	}
+	parsed.Scheme = "https"
+	return parsed.String()
+}
 
-	log.Printf("Successfully downloaded %d bytes: %s → %s", written, finalURL, filePath) // Log success
+// Sends a GET request to the URL, retrying the same path against the next mirror
+// on a connection failure or 5xx response, and over http when the https upgrade
+// gets any non-2xx response. Any other response is returned as is.
+func getWithMirrors(ctx context.Context, client *http.Client, rawURL string) (*http.Response, error) {
+	var lastErr error
+	candidates := mirrorCandidates(ctx, rawURL)
+	upgraded := false                                       // Whether candidates starts with the https form of rawURL
+	if secure := upgradeToHTTPS(rawURL); secure != rawURL { // Plain http first falls back after https fails
+		debugf(ctx, "Upgrading %s to https", rawURL)
+		candidates = append([]string{secure}, candidates...)
+		upgraded = true
+	}
+	for index, candidate := range candidates {
+		// The original http URL after its https upgrade failed; not a retry, since it was the only request before -prefer-https
+		fallback := upgraded && index == 1
+		if index > 0 && !fallback && !retries.take() { // Each failover is an extra attempt
+			logf(ctx, "Retry budget exhausted; not trying %s", candidate)
+			break
+		}
+		req, err := newRequest(ctx, http.MethodGet, candidate) // Build HTTP GET request
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp, err := sendRequest(client, req)
+		if err != nil { // Connection failure, try the next host
+			logf(ctx, "Request to %s failed: %v", req.URL.Host, err)
+			lastErr = fmt.Errorf("%w: %w", ErrNetwork, err)
+			continue
+		}
+		if resp.StatusCode >= 500 { // Server error, try the next host
+			logf(ctx, "Request to %s failed: %s", req.URL.Host, resp.Status)
+			resp.Body.Close()
+			lastErr = &BadStatusError{Code: resp.StatusCode, Status: resp.Status}
+			continue
+		}
+		if upgraded && index == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) { // e.g. a 404 from an https site missing old http-only files
+			logf(ctx, "https request for %s failed (%s); falling back to http", rawURL, resp.Status)
+			resp.Body.Close()
+			lastErr = &BadStatusError{Code: resp.StatusCode, Status: resp.Status}
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// Downloads one PDF straight to w, skipping the filename, existence and manifest
+// handling. The body must start with the PDF magic bytes, checked before anything is written.
+func (downloader *Downloader) streamPDF(ctx context.Context, uri string, w io.Writer) (int64, error) {
+	resp, err := getWithMirrors(ctx, downloader.Client, uri)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, &BadStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	body := bufio.NewReader(resp.Body)
+	head, _ := body.Peek(512)
+	if len(head) == 0 {
+		return 0, ErrEmptyBody
+	}
+	if sniffed := http.DetectContentType(head); sniffed != "application/pdf" { // Whatever the header says, only a PDF goes down the pipe
+		return 0, fmt.Errorf("%w: content type %q, sniffed as %q", ErrNotPDF, resp.Header.Get("Content-Type"), sniffed)
+	}
+	written, err := io.Copy(w, limitBandwidth(ctx, body))
+	if err != nil {
+		return written, fmt.Errorf("%w: reading body: %w", ErrNetwork, err)
+	}
+	return written, nil
+}
+
+// A product image queued by -download-images
+type productImage struct {
+	URL     string // Absolute image URL
+	Product string // Product page the image appeared on
+}
+
+// Drops images found on more than one product page, which are site-wide logos
+// and icons rather than product photos
+func productImages(images []productImage) []productImage {
+	pages := make(map[string]map[string]bool) // Image URL → distinct product pages it appeared on
+	for _, image := range images {
+		if pages[image.URL] == nil {
+			pages[image.URL] = make(map[string]bool)
+		}
+		pages[image.URL][image.Product] = true
+	}
+	var kept []productImage
+	queued := make(map[string]bool) // An image shown twice on its one page is still downloaded once
+	for _, image := range images {
+		if len(pages[image.URL]) > 1 || queued[image.URL] {
+			continue
+		}
+		queued[image.URL] = true
+		kept = append(kept, image)
+	}
+	return kept
+}
+
+// Name an image is saved under: the product slug and the image's own name, e.g.
+// dual_blend_1_front.jpg, so every product's images sort together
+func (downloader *Downloader) imageFilename(image productImage) string {
+	lastSegment := func(rawURL string) string { // Unescaped, without the query string
+		if parsed, err := url.Parse(rawURL); err == nil {
+			return path.Base(parsed.Path)
+		}
+		return rawURL
+	}
+	product := strings.TrimSuffix(downloader.Sanitizer(lastSegment(image.Product)), ".pdf")
+	name := strings.TrimSuffix(downloader.Sanitizer(lastSegment(image.URL)), ".pdf")
+	extension := imageExtension(image.URL)
+	for _, suffix := range []string{extension, "_" + strings.TrimPrefix(extension, ".")} { // urlToFilename turns ".jpg" into "_jpg"
+		if len(name) > len(suffix) && strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+			name = name[:len(name)-len(suffix)]
+		}
+	}
+	return product + "_" + name + extension
+}
+
+// Downloads a product image into the images subdirectory unless it is already there,
+// writing it as saveDocument does and recording it in the manifest. Returns the saved
+// path and ErrFileExists for an image kept from an earlier run.
+func (downloader *Downloader) downloadImage(ctx context.Context, image productImage, outputDir string, records *manifest) (string, error) {
+	imagesDir := filepath.Join(outputDir, imagesDirname)
+	filePath := filepath.Join(imagesDir, downloader.imageFilename(image))
+	if fileExists(filePath) && !*forceDownload {
+		return filePath, ErrFileExists
+	}
+	resp, err := getWithMirrors(ctx, downloader.Client, image.URL)
+	if err != nil {
+		return filePath, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return filePath, &BadStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	body := bufio.NewReader(resp.Body)
+	head, _ := body.Peek(512)
+	sniffed := http.DetectContentType(head)
+	if !slices.Contains(imageTypes[imageExtension(image.URL)], sniffed) { // An error page served in place of the image
+		return filePath, fmt.Errorf("content type %q, sniffed as %q (expected an image)", resp.Header.Get("Content-Type"), sniffed)
+	}
+	data, err := io.ReadAll(limitBandwidth(ctx, body))
+	totalBytes.Add(int64(len(data)))
+	if err != nil {
+		return filePath, fmt.Errorf("%w: reading body: %w", ErrNetwork, err)
+	}
+	if !directoryExists(imagesDir) {
+		createDirectory(imagesDir, dirMode)
+	}
+	if err := replaceFile(filePath, data); err != nil {
+		return filePath, err
+	}
+	preserveLastModified(ctx, filePath, resp.Header.Get("Last-Modified"))
+	records.add(ctx, manifestEntry{URL: image.URL, Source: image.Product}, outputDir, filePath)
+	return filePath, nil
+}
+
+// Limits parallel downloads for -concurrency auto with an AIMD controller: the
+// limit grows by one after a full round of downloads that succeed without slowing
+// down, and halves on an overload error or when a download takes over twice the usual time.
+type concurrencyController struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	ctx       context.Context
+	limit     int           // Downloads allowed at once
+	max       int           // Ceiling for limit (-max-concurrency)
+	active    int           // Downloads in progress
+	successes int           // Successful downloads since the limit last changed
+	latency   time.Duration // Moving average of successful download times
+}
+
+// Creates a controller starting at one download at a time; waiting workers are
+// released when ctx ends
+func newConcurrencyController(ctx context.Context, ceiling int) *concurrencyController {
+	controller := &concurrencyController{ctx: ctx, limit: 1, max: ceiling}
+	controller.cond = sync.NewCond(&controller.mutex)
+	context.AfterFunc(ctx, func() {
+		controller.mutex.Lock()
+		controller.cond.Broadcast()
+		controller.mutex.Unlock()
+	})
+	return controller
+}
+
+// Waits for a download slot; false if the run was stopped while waiting
+func (controller *concurrencyController) acquire() bool {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	for controller.active >= controller.limit && controller.ctx.Err() == nil {
+		controller.cond.Wait()
+	}
+	if controller.ctx.Err() != nil {
+		return false
+	}
+	controller.active++
 	return true
 }
 
-// Performs HTTP GET request and returns response body as string
-func getDataFromURL(uri string) string {
-	log.Println("Scraping", uri)   // Log which URL is being scraped
-	response, err := http.Get(uri) // Send GET request
+// Frees a slot taken by acquire
+func (controller *concurrencyController) release() {
+	controller.mutex.Lock()
+	controller.active--
+	controller.cond.Broadcast()
+	controller.mutex.Unlock()
+}
+
+// Reports whether a download error suggests the network or origin is overloaded:
+// a connection failure, 429 or 5xx. A 404 or a non-PDF response does not.
+func isOverloadError(err error) bool {
+	var status *BadStatusError
+	if errors.As(err, &status) {
+		return status.Code == http.StatusTooManyRequests || status.Code >= 500
+	}
+	return errors.Is(err, ErrNetwork)
+}
+
+// Adjusts the limit after a download that took elapsed and did or did not hit an overload error
+func (controller *concurrencyController) record(ctx context.Context, elapsed time.Duration, overloaded bool) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	previous := controller.limit
+	switch {
+	case overloaded:
+		controller.limit = max(controller.limit/2, 1)
+		controller.successes = 0
+	case controller.latency > 0 && elapsed > 2*controller.latency: // The network or origin is slowing down
+		controller.limit = max(controller.limit/2, 1)
+		controller.successes = 0
+		controller.latency = (controller.latency*7 + elapsed) / 8
+	default:
+		if controller.latency == 0 {
+			controller.latency = elapsed
+		} else {
+			controller.latency = (controller.latency*7 + elapsed) / 8
+		}
+		controller.successes++
+		if controller.successes >= controller.limit && controller.limit < controller.max {
+			controller.limit++
+			controller.successes = 0
+		}
+	}
+	if controller.limit != previous {
+		debugf(ctx, "Concurrency %d -> %d (average download %s)", previous, controller.limit, controller.latency.Round(time.Millisecond))
+		controller.cond.Broadcast()
+	}
+}
+
+// Fetches a file of known size as parallel byte ranges and reassembles them in order
+func downloadRanges(ctx context.Context, client *http.Client, uri string, size int64, chunks int) ([]byte, error) {
+	data := make([]byte, size)                              // Every chunk is read straight into its slot
+	chunkSize := (size + int64(chunks) - 1) / int64(chunks) // Round up so the chunks cover the whole file
+	errs := make([]error, chunks)
+	received := make([]int, chunks) // Bytes actually read per chunk
+	var wg sync.WaitGroup
+	for index := 0; index < chunks; index++ {
+		start := int64(index) * chunkSize
+		if start >= size {
+			break
+		}
+		end := min(start+chunkSize, size) - 1 // Inclusive end offset of this chunk
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			received[index], errs[index] = downloadRange(ctx, client, uri, start, data[start:end+1])
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, count := range received {
+		total += int64(count)
+	}
+	if total != size { // Verify the reassembled size matches Content-Length
+		return nil, fmt.Errorf("reassembled %d bytes, expected %d", total, size)
+	}
+	return data, nil
+}
+
+// Fetches the byte range starting at offset into the given slot and returns the bytes read
+func downloadRange(ctx context.Context, client *http.Client, uri string, offset int64, slot []byte) (int, error) {
+	req, err := newRequest(ctx, http.MethodGet, uri)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(slot))-1))
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()                           // Ensure response body is closed
+	if resp.StatusCode != http.StatusPartialContent { // The server ignored the Range header
+		return 0, fmt.Errorf("range %d+%d: unexpected status %s", offset, len(slot), resp.Status)
+	}
+	read, err := io.ReadFull(limitBandwidth(ctx, resp.Body), slot)
+	if err != nil {
+		return read, fmt.Errorf("range %d+%d: %w", offset, len(slot), err)
+	}
+	return read, nil
+}
+
+// Returns the sanitized filename from a Content-Disposition header, or "" when absent or unusable.
+// Any directory components are discarded so the name cannot escape the output directory.
+func (downloader *Downloader) dispositionFilename(header string) string {
+	if header == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(header) // Handles quoted, unquoted and RFC 5987 (filename*) forms
+	if err != nil {
+		return ""
+	}
+	name := strings.ReplaceAll(params["filename"], "\\", "/") // Treat Windows separators as separators too
+	name = path.Base(name)                                    // Drop any directory components
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return downloader.Sanitizer(name) // Apply the same filesystem-safe sanitizing as URL-derived names
+}
+
+// Download failure kinds, usable with errors.Is
+var (
+	ErrFileExists  = errors.New("file already exists")           // The target file is already on disk; not a failure
+	ErrNetwork     = errors.New("network error")                 // The request could not be completed
+	ErrNotPDF      = errors.New("response is not a PDF")         // The content type is not an accepted PDF type
+	ErrEmptyBody   = errors.New("response body is empty")        // Zero bytes were received
+	ErrTooSmall    = errors.New("response body is too small")    // Fewer bytes than -min-filesize were received
+	ErrAlias       = errors.New("same document as a saved file") // -head-dedupe matched another URL's download; not a failure
+	ErrUnchanged   = errors.New("content unchanged")             // -no-skip-existing downloaded the bytes already on disk; not a failure
+	ErrTooFewPages = errors.New("document has too few pages")    // A PDF with fewer pages than -min-pages, e.g. a placeholder
+)
+
+// BadStatusError reports a response with an unexpected HTTP status; use errors.As to inspect the code
+type BadStatusError struct {
+	Code   int    // HTTP status code
+	Status string // Full status line, e.g. "404 Not Found"
+}
+
+func (err *BadStatusError) Error() string {
+	return "unexpected status " + err.Status
+}
+
+// Decides where a URL is saved when its target path may already hold a file.
+// Returns the path to use and whether that file already holds this URL's document.
+// Files with no manifest entry are assumed to belong to the URL, as before the manifest existed.
+func resolveCollision(ctx context.Context, filePath string, uri string, outputDir string, records *manifest) (string, bool) {
+	if documentArchive != nil { // Nothing is saved to the directory; the archive's entries decide
+		return filePath, documentArchive.has(filepath.Base(filePath)) && !redownloadExisting()
+	}
+	stored := storedPath(filePath)
+	if !fileExists(stored) {
+		return filePath, false
+	}
+	owner := records.lookup(recordedPath(outputDir, stored)).URL
+	if owner == "" || owner == uri { // Same document as before
+		return stored, !redownloadExisting()
+	}
+	switch *onCollision {
+	case "overwrite":
+		logf(ctx, "%s was saved from %s; overwriting it with %s", filePath, owner, uri)
+		return filePath, false
+	case "suffix":
+		extension := filepath.Ext(filePath)
+		base := strings.TrimSuffix(filePath, extension)
+		for number := 2; ; number++ {
+			candidate := fmt.Sprintf("%s_%d%s", base, number, extension)
+			if !fileExists(storedPath(candidate)) {
+				return candidate, false
+			}
+			if records.lookup(recordedPath(outputDir, storedPath(candidate))).URL == uri { // Saved under this suffix by an earlier run
+				return storedPath(candidate), !redownloadExisting()
+			}
+		}
+	default: // skip
+		logf(ctx, "%s was saved from %s; skipping colliding %s", stored, owner, uri)
+		return stored, true
+	}
+}
+
+// Parsed -name-template; nil when filenames come from urlToFilename
+var filenameTemplate *template.Template
+
+// Matches a {placeholder} in the shorthand template syntax
+var placeholderPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// Parses a -name-template, turning {placeholder} shorthand into text/template actions
+func parseNameTemplate(value string) (*template.Template, error) {
+	if !strings.Contains(value, "{{") {
+		value = placeholderPattern.ReplaceAllString(value, "{{.$1}}")
+	}
+	return template.New("name").Option("missingkey=error").Parse(value)
+}
+
+// Characters not allowed in a templated filename
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Makes a templated name safe to use as a single file in the output directory
+func sanitizeFilename(name string) string {
+	name = unsafeFilenameChars.ReplaceAllString(name, "_")
+	name = strings.TrimLeft(name, "._") // No hidden files or ".." components
+	if name == "" {
+		return ""
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".pdf") {
+		name += ".pdf"
+	}
+	return name
+}
+
+// Renders -name-template for a downloaded document. Only placeholders with a value are
+// defined, so a template using one that cannot be resolved (e.g. {date} without a
+// Last-Modified header) fails and "" is returned, letting the caller fall back.
+func templatedFilename(uri string, header http.Header, data []byte) string {
+	fields := make(map[string]string)
+	if parsed, err := url.Parse(uri); err == nil {
+		fields["host"] = parsed.Hostname()
+		if base := path.Base(parsed.Path); base != "/" && base != "." {
+			fields["product"] = strings.TrimSuffix(base, path.Ext(base))
+		}
+	}
+	if modified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		fields["date"] = modified.UTC().Format("2006-01-02")
+	}
+	digest := sha256.Sum256(data)
+	fields["hash"] = hex.EncodeToString(digest[:])[:12]
+	var name strings.Builder
+	if err := filenameTemplate.Execute(&name, fields); err != nil {
+		return ""
+	}
+	return sanitizeFilename(name.String())
+}
+
+// Returns where a document is stored: the path itself, or the .gz variant written by -compress
+func storedPath(filePath string) string {
+	if !fileExists(filePath) && fileExists(filePath+".gz") {
+		return filePath + ".gz"
+	}
+	return filePath
+}
+
+// Writes a downloaded document, gzipped to <path>.gz with -compress. The other
+// variant left by an earlier run in the other mode is removed along with its
+// manifest entry. Returns the path written.
+func saveDocument(filePath string, data []byte, outputDir string, records *manifest) (string, error) {
+	plain := strings.TrimSuffix(filePath, ".gz")
+	target, stale := plain, plain+".gz"
+	if *compressPDFs {
+		target, stale = stale, target
+	}
+	if *compressPDFs {
+		var compressed bytes.Buffer
+		compressor := gzip.NewWriter(&compressed)
+		compressor.Name = filepath.Base(plain) // gunzip restores the original name
+		if _, err := compressor.Write(data); err != nil {
+			return target, fmt.Errorf("compressing file: %w", err)
+		}
+		if err := compressor.Close(); err != nil {
+			return target, fmt.Errorf("compressing file: %w", err)
+		}
+		data = compressed.Bytes()
+	}
+	if err := replaceFile(target, data); err != nil {
+		return target, err
+	}
+	if fileExists(stale) {
+		removeFile(stale)
+		records.remove(recordedPath(outputDir, stale))
+	}
+	return target, nil
+}
+
+// Writes data to <path>.part and renames it over path, so a crash or full disk never
+// leaves a half-written file, or a truncated copy in place of a good one, under the
+// final name. cleanupLeftovers removes .part files a crash leaves behind.
+func replaceFile(path string, data []byte) error {
+	partial := path + ".part"
+	if err := os.WriteFile(partial, data, fileMode); err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("writing file: %w", err)
+	}
+	if err := os.Rename(partial, path); err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("replacing file: %w", err)
+	}
+	return nil
+}
+
+// The -archive file documents are written into instead of the output directory; nil without -archive
+var documentArchive *archiveWriter
+
+// Writes documents into a .tar.gz or .zip. The new archive is built next to the
+// target and renamed over it by close, after the entries of the previous archive
+// that were not downloaded again are copied across.
+type archiveWriter struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File     // The archive being built, at path + ".part"
+	gzipped  *gzip.Writer // Under tarball for .tar.gz
+	tarball  *tar.Writer
+	zipped   *zip.Writer
+	previous map[string]bool // Entries of the archive left by an earlier run
+	written  map[string]bool // Entries added by this run
+	closed   bool
+}
+
+// Returns "tar.gz" or "zip" for a supported -archive filename, or ""
+func archiveFormat(path string) string {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	}
+	return ""
+}
+
+// Starts a new archive at path, indexing the entries of the one already there
+func openArchive(path string) (*archiveWriter, error) {
+	archive := &archiveWriter{path: path, previous: make(map[string]bool), written: make(map[string]bool)}
+	if fileExists(path) {
+		err := archive.eachPrevious(func(name string, _ func() error) error {
+			archive.previous[name] = true
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading archive %s: %w", path, err)
+		}
+	}
+	file, err := os.OpenFile(path+".part", os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileMode)
+	if err != nil {
+		return nil, fmt.Errorf("creating archive: %w", err)
+	}
+	archive.file = file
+	if archiveFormat(path) == "zip" {
+		archive.zipped = zip.NewWriter(file)
+	} else {
+		archive.gzipped = gzip.NewWriter(file)
+		archive.tarball = tar.NewWriter(archive.gzipped)
+	}
+	return archive, nil
+}
+
+// Calls visit for each entry of the previous archive; its copy function writes the
+// entry into the archive being built, and is only valid when a writer is open
+func (archive *archiveWriter) eachPrevious(visit func(name string, copyEntry func() error) error) error {
+	if archiveFormat(archive.path) == "zip" {
+		reader, err := zip.OpenReader(archive.path)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		for _, entry := range reader.File {
+			if err := visit(entry.Name, func() error { return archive.zipped.Copy(entry) }); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	file, err := os.Open(archive.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decompressed, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	reader := tar.NewReader(decompressed)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err = visit(header.Name, func() error {
+			if err := archive.tarball.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err := io.Copy(archive.tarball, reader)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Reports whether the archive holds an entry with this name, from this run or an earlier one
+func (archive *archiveWriter) has(name string) bool {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	return archive.written[name] || archive.previous[name]
+}
+
+// Adds a document as an entry dated modified, with its source URL and SHA-256 in the
+// entry's comment (a PAX record in a tarball)
+func (archive *archiveWriter) add(name, uri string, data []byte, modified time.Time) error {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	if archive.closed {
+		return fmt.Errorf("archive %s is already finalized", archive.path)
+	}
+	digest := sha256.Sum256(data)
+	var writer io.Writer
+	var err error
+	if archive.zipped != nil {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified, Comment: uri + " sha256:" + hex.EncodeToString(digest[:])}
+		header.SetMode(fileMode)
+		writer, err = archive.zipped.CreateHeader(header)
+	} else {
+		err = archive.tarball.WriteHeader(&tar.Header{
+			Name: name, Mode: int64(fileMode), Size: int64(len(data)), ModTime: modified, Format: tar.FormatPAX,
+			PAXRecords: map[string]string{"comment": uri + " sha256:" + hex.EncodeToString(digest[:])}, // A standard record, so tar doesn't warn about it
+		})
+		writer = archive.tarball
+	}
+	if err != nil {
+		return fmt.Errorf("adding %s to archive: %w", name, err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		return fmt.Errorf("adding %s to archive: %w", name, err)
+	}
+	archive.written[name] = true
+	return nil
+}
+
+// Copies over the previous archive's remaining entries, finishes the archive and
+// moves it into place. Safe to call more than once; later calls do nothing.
+func (archive *archiveWriter) close() error {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	if archive.closed {
+		return nil
+	}
+	archive.closed = true
+	var err error
+	kept := 0
+	if len(archive.previous) > 0 { // Keep what earlier runs archived and this one did not replace
+		err = archive.eachPrevious(func(name string, copyEntry func() error) error {
+			if archive.written[name] {
+				return nil
+			}
+			kept++
+			return copyEntry()
+		})
+	}
+	if archive.zipped != nil {
+		err = errors.Join(err, archive.zipped.Close())
+	} else {
+		err = errors.Join(err, archive.tarball.Close(), archive.gzipped.Close())
+	}
+	err = errors.Join(err, archive.file.Close())
+	if err != nil { // Leave the previous archive as it was
+		return fmt.Errorf("finalizing archive %s: %w (partial archive left at %s)", archive.path, err, archive.file.Name())
+	}
+	if err := os.Rename(archive.file.Name(), archive.path); err != nil {
+		return fmt.Errorf("finalizing archive %s: %w", archive.path, err)
+	}
+	log.Printf("Wrote %d new and %d kept document(s) to %s", len(archive.written), kept, archive.path)
+	return nil
+}
+
+// Returns the URLs whose document is not yet on disk, either under its derived
+// filename or under the path the manifest recorded for it
+func (downloader *Downloader) missingURLs(urls []string, outputDir string, records *manifest) []string {
+	saved := make(map[string]bool)
+	for _, entry := range records.Entries {
+		if fileExists(filepath.Join(outputDir, filepath.FromSlash(entry.Path))) {
+			saved[entry.URL] = true
+			if entry.Bundle != "" {
+				saved[entry.Bundle] = true
+			}
+		}
+	}
+	var missing []string
+	for _, uri := range urls {
+		if saved[uri] || fileExists(storedPath(filepath.Join(outputDir, downloader.Sanitizer(uri)))) {
+			continue
+		}
+		missing = append(missing, uri)
+	}
+	return missing
+}
+
+// Parses a duration such as 24h, 90m or 7d; "d" is 24 hours
+func parseAge(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(strings.TrimSpace(value), "d"); found {
+		count, err := strconv.ParseFloat(days, 64)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(count * float64(24*time.Hour)), nil
+	}
+	age, err := time.ParseDuration(value)
+	if err == nil && age < 0 {
+		err = fmt.Errorf("invalid duration %q", value)
+	}
+	return age, err
+}
+
+// Drops URLs whose local copy was saved less than window ago. The save time comes
+// from the manifest, since file times are set to the server's Last-Modified; files
+// without a manifest entry fall back to their modification time.
+func (downloader *Downloader) withoutRecent(urls []string, outputDir string, records *manifest, window time.Duration) []string {
+	savedAt := make(map[string]time.Time)
+	for _, entry := range records.Entries {
+		if entry.DownloadedAt.After(savedAt[entry.URL]) && fileExists(filepath.Join(outputDir, filepath.FromSlash(entry.Path))) {
+			savedAt[entry.URL] = entry.DownloadedAt
+		}
+	}
+	cutoff := time.Now().Add(-window)
+	var kept []string
+	for _, uri := range urls {
+		saved, found := savedAt[uri]
+		if !found {
+			if info, err := os.Stat(storedPath(filepath.Join(outputDir, downloader.Sanitizer(uri)))); err == nil {
+				saved, found = info.ModTime(), true
+			}
+		}
+		if found && saved.After(cutoff) {
+			continue
+		}
+		kept = append(kept, uri)
+	}
+	return kept
+}
+
+// Sets a saved file's modification time to the server's Last-Modified date so
+// ls -l and rsync reflect the document's real date. Without a usable header the
+// file keeps the time it was written.
+func preserveLastModified(ctx context.Context, filePath string, lastModified string) {
+	if lastModified == "" {
+		return
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		debugf(ctx, "Ignoring unparseable Last-Modified %q for %s", lastModified, filePath)
+		return
+	}
+	if err := os.Chtimes(filePath, time.Time{}, modified); err != nil { // Zero atime leaves it unchanged
+		logf(ctx, "%v", err)
+	}
+}
+
+// Largest PDF extracted from a zip bundle; guards against zip bombs
+const maxZipEntrySize = 512 << 20
+
+// Returns where the zip bundle for a derived PDF path is kept: the sanitized stem without
+// the ".pdf" the sanitizer added or the zip extension it kept, e.g. bundle_zip.pdf
+// (strict naming) and bundle.zip.pdf (relaxed naming) both give bundle.zip
+func bundlePath(filePath string) string {
+	stem := strings.TrimSuffix(filePath, ".pdf")
+	for _, suffix := range []string{"_zip", ".zip"} {
+		if len(stem) > len(suffix) && strings.EqualFold(stem[len(stem)-len(suffix):], suffix) {
+			stem = stem[:len(stem)-len(suffix)]
+			break
+		}
+	}
+	return stem + ".zip"
+}
+
+// Saves a downloaded zip bundle and extracts the PDFs in it into the output directory
+// under sanitized names. Each entry is checked like a downloaded PDF and recorded in
+// the manifest as <bundle URL>#<entry name>; entries whose flattened names clash are
+// resolved by -on-collision. Entries with absolute or parent-relative paths (zip-slip)
+// are refused. Returns the bundle's path.
+func (downloader *Downloader) saveZipBundle(ctx context.Context, uri string, data []byte, filePath string, outputDir string, records *manifest) (string, error) {
+	zipPath := bundlePath(filePath)
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return zipPath, fmt.Errorf("%w: unreadable zip bundle: %w", ErrNotPDF, err)
+	}
+	if err := replaceFile(zipPath, data); err != nil { // A partial bundle would be taken as kept by an earlier run
+		return zipPath, err
+	}
+	var extracted []string
+	for _, file := range archive.File {
+		name := file.Name
+		if file.FileInfo().IsDir() || !strings.HasSuffix(strings.ToLower(name), ".pdf") {
+			continue
+		}
+		cleaned := path.Clean(strings.ReplaceAll(name, `\`, "/"))
+		if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") || filepath.VolumeName(cleaned) != "" {
+			logf(ctx, "Refusing unsafe path %q in %s", name, uri)
+			continue
+		}
+		entryURL := uri + "#" + cleaned                                              // Tells entries with the same base name apart
+		target := filepath.Join(outputDir, downloader.Sanitizer(path.Base(cleaned))) // Flattened and sanitized
+		target, exists := resolveCollision(ctx, target, entryURL, outputDir, records)
+		if exists {
+			logf(ctx, "File already exists, skipping %q from %s: %s", name, uri, target)
+			continue
+		}
+		content, err := readZipEntry(file)
+		if err == nil {
+			err = checkExtractedPDF(ctx, entryURL, content)
+		}
+		if err == nil {
+			target, err = saveDocument(target, content, outputDir, records)
+		}
+		if err != nil {
+			logf(ctx, "Failed to extract %q from %s: %v", name, uri, err)
+			continue
+		}
+		records.add(ctx, manifestEntry{URL: entryURL, Bundle: uri}, outputDir, target)
+		extracted = append(extracted, target)
+	}
+	if len(extracted) > 0 { // For processURL to check against -expected-hashes
+		bundleEntries.Store(uri, extracted)
+	}
+	logf(ctx, "Extracted %d PDF(s) from %s → %s", len(extracted), uri, zipPath)
+	if *removeZips {
+		if err := os.Remove(zipPath); err != nil {
+			logf(ctx, "%v", err)
+		}
+	}
+	return zipPath, nil
+}
+
+// Documents extracted from each zip bundle this run, until processURL checks their hashes
+var bundleEntries sync.Map
+
+// Reads one zip entry, refusing entries larger than maxZipEntrySize
+func readZipEntry(file *zip.File) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxZipEntrySize+1))
+	if err == nil && len(data) > maxZipEntrySize {
+		err = fmt.Errorf("entry exceeds %s", formatBytes(maxZipEntrySize))
+	}
+	return data, err
+}
+
+// Applies the checks a downloaded PDF passes to a PDF extracted from a bundle:
+// the %PDF signature, -min-filesize, -min-pages and -validate-pdf-structure
+func checkExtractedPDF(ctx context.Context, source string, data []byte) error {
+	if len(data) == 0 {
+		return ErrEmptyBody
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return fmt.Errorf("%w: sniffed as %q", ErrNotPDF, http.DetectContentType(data))
+	}
+	if int64(len(data)) < *minFileSize {
+		return fmt.Errorf("%w: %d bytes, below -min-filesize of %d", ErrTooSmall, len(data), *minFileSize)
+	}
+	if err := checkMinPages(ctx, source, data); err != nil {
+		return err
+	}
+	if *validatePDFStructure {
+		if err := checkPDFData(data); err != nil {
+			return fmt.Errorf("invalid PDF structure: %w", err)
+		}
+	}
+	return nil
+}
+
+// Downloads a PDF from given URL and saves it in the specified directory.
+// Returns the path the file was (or would have been) saved to and nil on success,
+// ErrFileExists when skipped, or an error matching one of the failure kinds above.
+func (downloader *Downloader) downloadPDF(ctx context.Context, finalURL, outputDir string, records *manifest) (string, error) {
+	filename := downloader.Sanitizer(finalURL)     // Sanitize the filename
+	filePath := filepath.Join(outputDir, filename) // Construct full path for output file
+
+	filePath, exists := resolveCollision(ctx, filePath, finalURL, outputDir, records)
+	if exists { // Skip if file already exists
+		return filePath, ErrFileExists
+	}
+	if filenameTemplate != nil && !redownloadExisting() { // The templated name is only known after downloading, so ask the manifest
+		if saved := records.pathFor(finalURL); saved != "" && fileExists(filepath.Join(outputDir, filepath.FromSlash(saved))) {
+			return filepath.Join(outputDir, filepath.FromSlash(saved)), ErrFileExists
+		}
+	}
+	if *extractZips && !*forceDownload && fileExists(bundlePath(filePath)) { // Bundle kept by an earlier run
+		return bundlePath(filePath), ErrFileExists
+	}
+	if *headDedupe && !*forceDownload { // Ask the server what the document is before fetching its bytes
+		if identity := downloader.headIdentity(ctx, finalURL); identity != "" {
+			if saved := records.withIdentity(identity); saved != "" && fileExists(filepath.Join(outputDir, filepath.FromSlash(saved))) {
+				records.addAlias(saved, finalURL)
+				return filepath.Join(outputDir, filepath.FromSlash(saved)), ErrAlias
+			}
+		}
+	}
+
+	client := downloader.Client // Shared HTTP client
+
+	resp, err := getWithMirrors(ctx, client, finalURL) // Send HTTP GET request, failing over to mirrors
+	if err != nil {
+		return filePath, err
+	}
+	defer resp.Body.Close() // Ensure response body is closed
+
+	debugf(ctx, "Response for %s: status=%q content-type=%q content-length=%q last-modified=%q etag=%q content-disposition=%q",
+		finalURL, resp.Status, resp.Header.Get("Content-Type"), resp.Header.Get("Content-Length"),
+		resp.Header.Get("Last-Modified"), resp.Header.Get("ETag"), resp.Header.Get("Content-Disposition"))
+
+	if resp.StatusCode != http.StatusOK { // Check if response is 200 OK
+		return filePath, &BadStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	if name := downloader.dispositionFilename(resp.Header.Get("Content-Disposition")); name != "" { // Prefer the server-provided filename
+		filePath, exists = resolveCollision(ctx, filepath.Join(outputDir, name), finalURL, outputDir, records)
+		if exists {
+			return filePath, ErrFileExists
+		}
+	}
+
+	body := bufio.NewReader(resp.Body)                                                                              // Buffered so the start of the body can be sniffed
+	contentType := resp.Header.Get("Content-Type")                                                                  // Get content type of response
+	if !strings.Contains(contentType, "binary/octet-stream") && !strings.Contains(contentType, "application/pdf") { // Check if it's a PDF
+		head, _ := body.Peek(512) // Missing or mislabeled header; let the content decide
+		sniffed := http.DetectContentType(head)
+		if *extractZips && (strings.Contains(contentType, "zip") || sniffed == "application/zip") {
+			debugf(ctx, "%s is a zip bundle (%q)", finalURL, contentType)
+		} else if sniffed != "application/pdf" {
+			return filePath, fmt.Errorf("%w: content type %q, sniffed as %q (expected binary/octet-stream or application/pdf)", ErrNotPDF, contentType, sniffed)
+		} else {
+			debugf(ctx, "%s is labeled %q but its content is a PDF; accepting it", finalURL, contentType)
+		}
+	}
+
+	var buf bytes.Buffer // Create a buffer to hold response data
+	var written int64
+	chunked := false
+	if *downloadChunks > 1 && resp.Header.Get("Accept-Ranges") == "bytes" && resp.ContentLength >= minChunkedSize { // Large file on a range-capable server
+		resp.Body.Close() // Free the connection rather than hold it open, unread, while the ranges download
+		data, err := downloadRanges(ctx, client, resp.Request.URL.String(), resp.ContentLength, *downloadChunks)
+		if err != nil {
+			logf(ctx, "Chunked download of %s failed, falling back to a single stream: %v", finalURL, err)
+			req, err := newRequest(ctx, http.MethodGet, resp.Request.URL.String()) // The first body is gone; ask again
+			if err != nil {
+				return filePath, err
+			}
+			stream, err := sendRequest(client, req)
+			if err != nil {
+				return filePath, fmt.Errorf("%w: %w", ErrNetwork, err)
+			}
+			defer stream.Body.Close() // Ensure response body is closed
+			if stream.StatusCode != http.StatusOK {
+				return filePath, &BadStatusError{Code: stream.StatusCode, Status: stream.Status}
+			}
+			body.Reset(stream.Body)
+		} else {
+			buf.Write(data) // Writing to a bytes.Buffer cannot fail
+			written = int64(len(data))
+			chunked = true
+		}
+	}
+	if !chunked {
+		written, err = io.Copy(&buf, limitBandwidth(ctx, body)) // Copy data into buffer
+		totalBytes.Add(written)
+		if err != nil && resp.ContentLength >= 0 { // Say how much of the announced body arrived
+			return filePath, fmt.Errorf("%w: reading body: %w (received %d of %d bytes)", ErrNetwork, err, written, resp.ContentLength)
+		} else if err != nil {
+			return filePath, fmt.Errorf("%w: reading body: %w", ErrNetwork, err)
+		}
+	} else {
+		totalBytes.Add(written)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength { // A flaky transfer, a proxy that altered the body, or ranges that did not add up
+		logf(ctx, "WARNING: received %d bytes from %s but Content-Length was %d; keeping the file", written, finalURL, resp.ContentLength)
+	}
+	if written == 0 { // Skip empty files
+		return filePath, ErrEmptyBody
+	}
+	if written < *minFileSize { // Skip suspiciously tiny files
+		return filePath, fmt.Errorf("%w: %d bytes, below -min-filesize of %d", ErrTooSmall, written, *minFileSize)
+	}
+	if err := checkMinPages(ctx, finalURL, buf.Bytes()); err != nil { // Catch placeholders that pass the size check
+		return filePath, err
+	}
+
+	if *extractZips && bytes.HasPrefix(buf.Bytes(), []byte("PK\x03\x04")) { // A bundle of PDFs rather than a PDF
+		return downloader.saveZipBundle(ctx, finalURL, buf.Bytes(), filePath, outputDir, records)
+	}
+
+	if filenameTemplate != nil { // Name the file from the template now that the content is known
+		name := templatedFilename(finalURL, resp.Header, buf.Bytes())
+		if name == "" {
+			debugf(ctx, "-name-template could not be resolved for %s; using %s", finalURL, filepath.Base(filePath))
+		} else {
+			filePath, exists = resolveCollision(ctx, filepath.Join(outputDir, name), finalURL, outputDir, records)
+			if exists {
+				return filePath, ErrFileExists
+			}
+		}
+	}
+
+	if *noSkipExisting && !*forceDownload && fileExists(storedPath(filePath)) { // Only replace a good copy with different content
+		same, err := sameContent(storedPath(filePath), buf.Bytes())
+		if err != nil {
+			logf(ctx, "Cannot compare with %s, replacing it: %v", storedPath(filePath), err)
+		} else if same {
+			return storedPath(filePath), ErrUnchanged
+		} else {
+			logf(ctx, "Content of %s differs from %s; replacing it", storedPath(filePath), finalURL)
+			replacedFiles.Add(1)
+		}
+	}
+
+	if documentArchive != nil { // An archive entry instead of a file
+		modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+		if err != nil {
+			modified = time.Now()
+		}
+		if err := documentArchive.add(filepath.Base(filePath), finalURL, buf.Bytes(), modified); err != nil {
+			return filePath, err
+		}
+		logf(ctx, "Successfully downloaded %d bytes from %s: %s → %s in %s", written, resp.Request.URL.Host, finalURL, filepath.Base(filePath), documentArchive.path)
+		return filePath, nil
+	}
+	filePath, err = saveDocument(filePath, buf.Bytes(), outputDir, records)
+	if err != nil {
+		return filePath, err
+	}
+	preserveLastModified(ctx, filePath, resp.Header.Get("Last-Modified"))
+	if identity := remoteIdentity(resp.Header, resp.ContentLength); identity != "" { // For the manifest entry, so -head-dedupe can recognize it
+		downloadIdentities.Store(finalURL, identity)
+	}
+
+	logf(ctx, "Successfully downloaded %d bytes from %s: %s → %s", written, resp.Request.URL.Host, finalURL, filePath) // Log success and the serving host
+	return filePath, nil
+}
+
+// Runs downloadPDF, downloading again up to -retry-on-content-mismatch times while the
+// response is not a PDF, e.g. from a cache that served an HTML page first
+func (downloader *Downloader) downloadWithContentRetries(ctx context.Context, uri, outputDir string, records *manifest) (string, error) {
+	filePath, err := downloader.downloadPDF(ctx, uri, outputDir, records)
+	for attempt := 1; errors.Is(err, ErrNotPDF) && attempt <= *contentRetries; attempt++ {
+		if !retries.take() {
+			logf(ctx, "Retry budget exhausted; not retrying %s", uri)
+			break
+		}
+		logf(ctx, "Content mismatch for %s (%v); retrying in %s (%d of %d)", uri, err, time.Duration(attempt)*time.Second, attempt, *contentRetries)
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second): // Give the cache time to fill
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		filePath, err = downloader.downloadPDF(ctx, uri, outputDir, records)
+	}
+	return filePath, err
+}
+
+// Remote identity of each URL downloaded this run, until processURL records it in the manifest
+var downloadIdentities sync.Map
+
+// Cheap identity of a remote document from its response headers: the ETag, or else
+// Last-Modified with the size. "" when the server sends neither.
+func remoteIdentity(header http.Header, size int64) string {
+	if etag := header.Get("ETag"); etag != "" {
+		return "etag " + etag
+	}
+	if modified := header.Get("Last-Modified"); modified != "" && size >= 0 {
+		return fmt.Sprintf("modified %s, %d bytes", modified, size)
+	}
+	return ""
+}
+
+// Returns the remote identity of a document from a HEAD request, or "" when it cannot be determined
+func (downloader *Downloader) headIdentity(ctx context.Context, uri string) string {
+	request, err := newRequest(ctx, http.MethodHead, uri)
+	if err != nil {
+		debugf(ctx, "%v", err)
+		return ""
+	}
+	response, err := sendRequest(downloader.Client, request)
+	if err != nil {
+		debugf(ctx, "%v", err)
+		return ""
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		debugf(ctx, "HEAD %s: %s", uri, response.Status)
+		return ""
+	}
+	return remoteIdentity(response.Header, response.ContentLength)
+}
+
+// Returns ErrTooFewPages for a PDF with fewer pages than -min-pages. PDFs the
+// parser cannot count are accepted, as are bodies that are not PDFs.
+func checkMinPages(ctx context.Context, source string, data []byte) error {
+	if *minPages <= 0 || !bytes.HasPrefix(data, []byte("%PDF")) {
+		return nil
+	}
+	if pages, err := pdfPageCount(data); err != nil {
+		debugf(ctx, "Cannot count the pages of %s, accepting it: %v", source, err)
+	} else if pages < *minPages {
+		return fmt.Errorf("%w: %d page(s), below -min-pages of %d", ErrTooFewPages, pages, *minPages)
+	}
+	return nil
+}
+
+// Counts the pages of an in-memory PDF
+func pdfPageCount(data []byte) (pages int, err error) {
+	defer func() { // The parser panics on some malformed input
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("malformed PDF: %v", recovered)
+		}
+	}()
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	return reader.NumPage(), nil
+}
+
+// Reports whether a saved document (gzipped by -compress or not) holds exactly the given bytes
+func sameContent(path string, data []byte) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close() // Ensure file is closed after reading
+	reader := io.Reader(file)
+	if strings.HasSuffix(path, ".gz") {
+		decompressor, err := gzip.NewReader(file)
+		if err != nil {
+			return false, err
+		}
+		reader = decompressor
+	}
+	saved := sha256.New()
+	if _, err := io.Copy(saved, reader); err != nil {
+		return false, err
+	}
+	downloaded := sha256.Sum256(data)
+	return bytes.Equal(saved.Sum(nil), downloaded[:]), nil
+}
+
+// Files -no-skip-existing replaced because their content differed
+var replacedFiles atomic.Int64
+
+// Whether files already on disk are downloaded again, with -force or -no-skip-existing
+func redownloadExisting() bool {
+	return *forceDownload || *noSkipExisting
+}
+
+// Path of the -extract-text file for a document: x.pdf and x.pdf.gz both get x.txt
+func textPath(documentPath string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(documentPath, ".gz"), ".pdf") + ".txt"
+}
+
+// Extracts the plain text of a saved PDF, gzipped by -compress or not
+func extractPDFText(path string) (text string, err error) {
+	defer func() { // The parser panics on some malformed input
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("malformed PDF: %v", recovered)
+		}
+	}()
+	reader, err := openSavedPDF(path)
+	if err != nil {
+		return "", err
+	}
+	plain, err := reader.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+	var builder strings.Builder
+	if _, err := io.Copy(&builder, plain); err != nil {
+		return "", err
+	}
+	return builder.String(), nil
+}
+
+// Writes the text of a PDF next to it for -extract-text. Image-only PDFs, which have
+// no text to extract, get a warning instead of an empty file.
+func writeTextExtraction(ctx context.Context, documentPath string) {
+	text, err := extractPDFText(documentPath)
+	if err != nil {
+		logf(ctx, "Cannot extract text from %s: %v", documentPath, err)
+		return
+	}
+	if strings.TrimSpace(text) == "" {
+		logf(ctx, "WARNING: no text in %s (image-only PDF?); not writing %s", documentPath, textPath(documentPath))
+		return
+	}
+	if err := os.WriteFile(textPath(documentPath), []byte(text), fileMode); err != nil {
+		logf(ctx, "%v", err)
+		return
+	}
+	debugf(ctx, "Extracted %d byte(s) of text to %s", len(text), textPath(documentPath))
+}
+
+// Reads a saved PDF, decompressing it first when -compress stored it as .pdf.gz
+func readSavedPDF(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(path, ".gz") {
+		decompressor, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(decompressor); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Parses a saved PDF, decompressing it first when -compress stored it as .pdf.gz
+func openSavedPDF(path string) (*pdf.Reader, error) {
+	data, err := readSavedPDF(path)
+	if err != nil {
+		return nil, err
+	}
+	return pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+}
+
+// Opens a PDF with a parser to verify its trailer/xref and that it has at least one page
+func checkPDFStructure(path string) error {
+	data, err := readSavedPDF(path)
+	if err != nil {
+		return err
+	}
+	return checkPDFData(data)
+}
+
+// Like checkPDFStructure, for a PDF in memory
+func checkPDFData(data []byte) (err error) {
+	defer func() { // The parser panics on some malformed input
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("malformed PDF: %v", recovered)
+		}
+	}()
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data))) // Parses the trailer and cross-reference table
+	if err != nil {
+		return err
+	}
+	if reader.NumPage() < 1 { // A valid SDS has at least one page
+		return errors.New("document has no pages")
+	}
+	return nil
+}
+
+// Moves a file into the quarantine subdirectory of the output directory
+func quarantineFile(ctx context.Context, path string, outputDir string) {
+	quarantineDir := filepath.Join(outputDir, "quarantine") // Directory holding rejected files
+	if !directoryExists(quarantineDir) {
+		createDirectory(quarantineDir, dirMode)
+	}
+	target := filepath.Join(quarantineDir, getFilename(path)) // Keep the original filename
+	err := os.Rename(path, target)
+	if err != nil {
+		logf(ctx, "%v", err)
+		return
+	}
+	logf(ctx, "Quarantined %s → %s", path, target)
+}
+
+// Loads a User-Agent pool from a file, one per line, ignoring blank lines and # comments.
+// An unreadable file or one without any User-Agent is an error rather than a silent default.
+func loadUserAgents(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading -user-agents: %w", err)
+	}
+	var agents []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		agents = append(agents, line)
+	}
+	if len(agents) == 0 {
+		return nil, fmt.Errorf("-user-agents %s lists no User-Agents", path)
+	}
+	return agents, nil
+}
+
+// Returns the next User-Agent from the pool in round-robin order
+func nextUserAgent() string {
+	index := userAgentIndex.Add(1) - 1 // Safe for concurrent callers
+	return userAgents[index%uint64(len(userAgents))]
+}
+
+// Adds the -cookie values to the client's jar for the NCL site
+func seedCookieJar(client *http.Client, values []string) error {
+	siteURL, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		cookies, err := http.ParseCookie(value)
+		if err != nil {
+			return fmt.Errorf("invalid -cookie %q: %w", value, err)
+		}
+		client.Jar.SetCookies(siteURL, cookies)
+	}
+	return nil
+}
+
+// Builds an outgoing HTTP request with the shared headers applied; cancelling ctx aborts it
+func newRequest(ctx context.Context, method string, uri string) (*http.Request, error) {
+	if isTraced(uri) {
+		ctx = withTrace(ctx, method+" "+uri)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", nextUserAgent()) // Rotate User-Agent per request
+	return request, nil
+}
+
+// Key under which the -trace label of a request is stored in its context
+type traceKey struct{}
+
+// Reports whether requests for a URL are traced: all of them with -trace, only the one given with -trace-url
+func isTraced(uri string) bool {
+	if *traceURL != "" {
+		return normalizePageURL(uri) == normalizePageURL(*traceURL)
+	}
+	return *traceRequests
+}
+
+// Returns a context that logs each step of the requests made with it: DNS, connecting,
+// TLS, connection reuse, the request written and the first response byte, each with
+// the time since the request started. Redirects made by the client are traced too.
+func withTrace(ctx context.Context, label string) context.Context {
+	started := time.Now()
+	var mutex sync.Mutex                     // Dual-stack dialing may connect to several addresses at once
+	connecting := make(map[string]time.Time) // Start of each connection attempt, by address
+	var dnsStarted, tlsStarted time.Time
+	trace := func(format string, args ...any) {
+		logf(ctx, "TRACE %s: %s (+%s)", label, fmt.Sprintf(format, args...), time.Since(started).Round(time.Microsecond))
+	}
+	return httptrace.WithClientTrace(context.WithValue(ctx, traceKey{}, label), &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			trace("getting connection to %s", hostPort)
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			dnsStarted = time.Now()
+			trace("resolving %s", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			trace("resolved to %v in %s (err: %v)", info.Addrs, time.Since(dnsStarted).Round(time.Microsecond), info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			mutex.Lock()
+			connecting[addr] = time.Now()
+			mutex.Unlock()
+			trace("connecting to %s %s", network, addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mutex.Lock()
+			elapsed := time.Since(connecting[addr])
+			mutex.Unlock()
+			trace("connected to %s %s in %s (err: %v)", network, addr, elapsed.Round(time.Microsecond), err)
+		},
+		TLSHandshakeStart: func() {
+			tlsStarted = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			trace("TLS handshake in %s: %s, %s, resumed %t (err: %v)", time.Since(tlsStarted).Round(time.Microsecond),
+				tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.DidResume, err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			trace("got connection to %s, reused %t (idle %s)", info.Conn.RemoteAddr(), info.Reused, info.IdleTime)
+		},
+		WroteHeaderField: func(key string, value []string) {
+			trace("> %s: %s", key, strings.Join(value, ", "))
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			trace("request written (err: %v)", info.Err)
+		},
+		GotFirstResponseByte: func() {
+			trace("first response byte")
+		},
+	})
+}
+
+// Tracks the URLs completed during the download phase so a crash loses at most one interval of progress
+type checkpoint struct {
+	mutex     sync.Mutex      // Guards the fields below while downloads run concurrently
+	path      string          // File the completed URLs are persisted to
+	interval  int             // Number of completions between writes
+	completed map[string]bool // URLs that are done
+	unsaved   int             // Completions since the last write
+}
+
+// Creates a checkpoint, loading previously completed URLs when resuming
+func newCheckpoint(path string, interval int, resume bool) *checkpoint {
+	progress := &checkpoint{path: path, interval: interval, completed: make(map[string]bool)}
+	if resume && fileExists(path) {
+		for _, line := range strings.Split(readAFileAsString(path), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				progress.completed[line] = true
+			}
+		}
+		log.Printf("Resuming from checkpoint with %d completed URL(s)", len(progress.completed))
+	}
+	return progress
+}
+
+// Records a completed URL and writes the checkpoint once the interval is reached
+func (progress *checkpoint) markDone(uri string) {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.completed[uri] = true
+	progress.unsaved++
+	if progress.interval > 0 && progress.unsaved >= progress.interval {
+		progress.write()
+	}
+}
+
+// Reports whether a URL was completed
+func (progress *checkpoint) isDone(uri string) bool {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	return progress.completed[uri]
+}
+
+// Writes all completed URLs to the checkpoint file
+func (progress *checkpoint) save() {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.write()
+}
+
+// Writes the checkpoint file; the caller holds the mutex
+func (progress *checkpoint) write() {
+	var urls []string
+	for uri := range progress.completed {
+		urls = append(urls, uri)
+	}
+	sort.Strings(urls)
+	temporaryPath := progress.path + ".tmp" // Write then rename so a crash never leaves a half-written checkpoint
+	err := os.WriteFile(temporaryPath, []byte(strings.Join(urls, "\n")+"\n"), fileMode)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = os.Rename(temporaryPath, progress.path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	progress.unsaved = 0
+}
+
+// Removes the checkpoint file after a clean completion
+func (progress *checkpoint) remove() {
+	if fileExists(progress.path) {
+		removeFile(progress.path)
+	}
+}
+
+// Computes the hex-encoded SHA-256 digest of a file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close() // Ensure file is closed after hashing
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Loads an -expected-hashes file in sha256sum format ("<digest>  <filename>", or "<digest> *<filename>"
+// for binary mode), keyed by base filename so the output of `sha256sum PDFs/*` works as is.
+// A file that cannot be read is an error, and so is a malformed line when strict is set;
+// otherwise malformed lines are logged and skipped.
+func loadExpectedHashes(path string, strict bool) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading -expected-hashes: %w", err)
+	}
+	expected := make(map[string]string)
+	for number, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, name, found := strings.Cut(line, " ")
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		decoded, err := hex.DecodeString(digest)
+		if !found || name == "" || err != nil || len(decoded) != sha256.Size {
+			if strict { // An unpinned document would pass unchecked
+				return nil, fmt.Errorf("malformed line %d in -expected-hashes %s: %s", number+1, path, line)
+			}
+			log.Printf("Ignoring malformed line %d in %s: %s", number+1, path, line)
+			continue
+		}
+		expected[filepath.Base(filepath.FromSlash(name))] = strings.ToLower(digest)
+	}
+	return expected, nil
+}
+
+// Reports whether a file in the output directory is tool state rather than a document
+func isBookkeepingFile(name string) bool {
+	return strings.HasPrefix(name, ".") || name == manifestFilename || name == referencesFilename || name == pendingFilename || name == reportFilename
+}
+
+// Hashes every document directly inside a directory, keyed by filename, using up to
+// workers goroutines. The first error in filename order is returned, whichever worker hit it.
+func hashDirectory(path string, workers int) (map[string]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isBookkeepingFile(entry.Name()) { // Skip subdirectories and bookkeeping files
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	// Results by position in names, so they don't depend on which worker finishes first
+	digests := make([]string, len(names))
+	failures := make([]error, len(names))
+	jobs := make(chan int)
+	var hashers sync.WaitGroup
+	for range min(max(workers, 1), max(len(names), 1)) {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+			for index := range jobs {
+				digests[index], failures[index] = fileSHA256(filepath.Join(path, names[index]))
+			}
+		}()
+	}
+	for index := range names {
+		jobs <- index
+	}
+	close(jobs)
+	hashers.Wait()
+	hashes := make(map[string]string, len(names))
+	for index, name := range names {
+		if failures[index] != nil {
+			return nil, failures[index]
+		}
+		hashes[name] = digests[index]
+	}
+	return hashes, nil
+}
+
+// Differences between two download sets
+type directoryDiff struct {
+	Added   []string `json:"added"`   // Files only in the current set
+	Removed []string `json:"removed"` // Files only in the previous set
+	Changed []string `json:"changed"` // Files in both sets whose content differs
+}
+
+// Compares two directories by filename and SHA-256, hashing on up to workers goroutines
+func compareDirectories(currentDir string, previousDir string, workers int) (directoryDiff, error) {
+	var diff directoryDiff
+	current, err := hashDirectory(currentDir, workers)
+	if err != nil {
+		return diff, err
+	}
+	previous, err := hashDirectory(previousDir, workers)
+	if err != nil {
+		return diff, err
+	}
+	for name, digest := range current {
+		previousDigest, found := previous[name]
+		if !found {
+			diff.Added = append(diff.Added, name)
+		} else if previousDigest != digest {
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name := range previous {
+		if _, found := current[name]; !found {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	sort.Strings(diff.Added) // Keep the report deterministic
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff, nil
+}
+
+// Prints a directory diff as a concise text report or as JSON
+func printDirectoryDiff(diff directoryDiff, asJSON bool) {
+	if asJSON {
+		encoded, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		fmt.Println(string(encoded))
+		return
+	}
+	for _, name := range diff.Added {
+		fmt.Println("+", name)
+	}
+	for _, name := range diff.Removed {
+		fmt.Println("-", name)
+	}
+	for _, name := range diff.Changed {
+		fmt.Println("~", name)
+	}
+	fmt.Printf("%d added, %d removed, %d changed\n", len(diff.Added), len(diff.Removed), len(diff.Changed))
+}
+
+// Prints, as CSV, the file each URL would be saved under and the earlier URL it collides
+// with, if any, for -resolve-only. Names that differ only in case collide, as they do on
+// case-insensitive filesystems. Returns the number of collisions.
+func (downloader *Downloader) printFilenameMapping(urls []string) (int, error) {
+	writer := csv.NewWriter(os.Stdout)
+	writer.Write([]string{"url", "filename", "collides_with"})
+	claimed := make(map[string]string) // Lowercased filename → first URL saved under it
+	collisions := 0
+	for _, uri := range urls {
+		filename := downloader.Sanitizer(uri)
+		key := strings.ToLower(filename)
+		first, taken := claimed[key]
+		if taken {
+			collisions++
+		} else {
+			claimed[key] = uri
+		}
+		writer.Write([]string{uri, filename, first})
+	}
+	writer.Flush()
+	return collisions, writer.Error()
+}
+
+// One row of the -list-products catalog
+type catalogEntry struct {
+	Slug      string `json:"slug"`
+	Name      string `json:"name"`
+	Category  string `json:"category,omitempty"`
+	Documents int    `json:"documents"` // Distinct PDFs linked from the page
+	URL       string `json:"url"`
+}
+
+// Builds the catalog of scraped product pages, sorted by slug. Pages outside
+// -category are left out.
+func buildCatalog(products map[string]productMetadata, references map[string][]string) []catalogEntry {
+	documents := make(map[string]int)
+	for _, pages := range references {
+		for _, page := range pages {
+			documents[page]++
+		}
+	}
+	var catalog []catalogEntry
+	for pageURL, metadata := range products {
+		if len(*categories) > 0 && !matchesCategory(metadata.Category, *categories) {
+			continue
+		}
+		slug := pageURL
+		if parsed, err := url.Parse(pageURL); err == nil {
+			if unescaped, err := url.PathUnescape(path.Base(parsed.Path)); err == nil {
+				slug = unescaped
+			}
+		}
+		catalog = append(catalog, catalogEntry{Slug: slug, Name: metadata.Name, Category: metadata.Category, Documents: documents[pageURL], URL: pageURL})
+	}
+	sort.Slice(catalog, func(i, j int) bool {
+		if catalog[i].Slug != catalog[j].Slug {
+			return catalog[i].Slug < catalog[j].Slug
+		}
+		return catalog[i].URL < catalog[j].URL
+	})
+	return catalog
+}
+
+// Prints the catalog to stdout as an aligned table, CSV or JSON
+func printCatalog(catalog []catalogEntry, format string) error {
+	switch format {
+	case "json":
+		encoded, err := json.MarshalIndent(catalog, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(encoded))
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write([]string{"slug", "name", "category", "documents", "url"})
+		for _, entry := range catalog {
+			writer.Write([]string{entry.Slug, entry.Name, entry.Category, strconv.Itoa(entry.Documents), entry.URL})
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "SLUG\tNAME\tSDS")
+		for _, entry := range catalog {
+			fmt.Fprintf(writer, "%s\t%s\t%d\n", entry.Slug, entry.Name, entry.Documents)
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		fmt.Printf("%d product(s)\n", len(catalog))
+	}
+	return nil
+}
+
+// Returns the names of every file the given URLs may have left in the output directory,
+// which -prune keeps: the document itself, its -compress and -extract-text siblings,
+// the bundle kept by -extract-zips, and any server-provided name in the manifest
+func (downloader *Downloader) expectedFiles(downloadURLs []string, records *manifest) map[string]bool {
+	expected := make(map[string]bool)
+	current := make(map[string]bool)
+	for _, urls := range downloadURLs {
+		expected[downloader.Sanitizer(urls)] = true
+		expected[downloader.Sanitizer(urls)+".gz"] = true       // Stored by -compress
+		expected[textPath(downloader.Sanitizer(urls))] = true   // Written by -extract-text
+		expected[bundlePath(downloader.Sanitizer(urls))] = true // Kept by -extract-zips
+		current[urls] = true
+	}
+	for _, entry := range records.Entries { // Files saved under a server-provided name
+		if current[entry.URL] || current[entry.Bundle] {
+			expected[entry.Path] = true
+			expected[textPath(entry.Path)] = true
+		}
+	}
+	return expected
+}
+
+// What the scrape saw of the site; -prune only trusts a scrape that saw all of it
+type scrapeCoverage struct {
+	FailedPages []string // Product pages that could not be fetched
+	Capped      bool     // -max-pages stopped the scrape before the last page
+	Filtered    bool     // -category, -exclude or -language dropped some of the links
+}
+
+// Returns why the scrape cannot tell which files are orphaned, or "" when it can
+func (coverage scrapeCoverage) incomplete() string {
+	switch {
+	case len(coverage.FailedPages) > 0:
+		return fmt.Sprintf("%d product page(s) could not be fetched", len(coverage.FailedPages))
+	case coverage.Capped:
+		return "-max-pages stopped the scrape early"
+	case coverage.Filtered:
+		return "-category, -exclude or -language filtered the links"
+	}
+	return ""
+}
+
+// Runs -prune against every PDF URL the scrape discovered, unless the scrape
+// was incomplete and would make referenced files look orphaned
+func (downloader *Downloader) pruneAfterScrape(outputDir string, discoveredURLs []string, records *manifest, coverage scrapeCoverage, confirm bool) {
+	if reason := coverage.incomplete(); reason != "" {
+		log.Printf("Skipping prune: %s", reason)
+		return
+	}
+	if len(discoveredURLs) == 0 { // An empty scrape would otherwise prune everything
+		log.Println("No PDF URLs were extracted; skipping prune")
+		return
+	}
+	pruneFiles(outputDir, downloader.expectedFiles(discoveredURLs, records), confirm)
+}
+
+// Moves regular files in the output directory that are not in the expected set into _removed/.
+// Without confirm it only logs what would be pruned.
+func pruneFiles(outputDir string, expected map[string]bool, confirm bool) {
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	removedDir := filepath.Join(outputDir, "_removed") // Orphans are kept here rather than deleted
+	var orphans []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isBookkeepingFile(entry.Name()) || expected[entry.Name()] { // Keep referenced files and bookkeeping
+			continue
+		}
+		orphans = append(orphans, entry.Name())
+	}
+	declined := confirm && len(orphans) > 0 && !confirmAction(fmt.Sprintf("Move %d unreferenced file(s) to %s?", len(orphans), removedDir))
+	if declined {
+		confirm = false // Fall back to listing them
+	}
+	for _, name := range orphans {
+		path := filepath.Join(outputDir, name)
+		if !confirm {
+			log.Printf("Would prune (dry run): %s", path)
+			continue
+		}
+		if !directoryExists(removedDir) {
+			createDirectory(removedDir, dirMode)
+		}
+		if err := os.Rename(path, filepath.Join(removedDir, name)); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("Pruned: %s", path)
+	}
+	if declined {
+		log.Printf("%d file(s) left in place; prune was not confirmed", len(orphans))
+	} else if !confirm && len(orphans) > 0 {
+		log.Printf("%d file(s) would be pruned; re-run with -prune-confirm to move them to %s", len(orphans), removedDir)
+	}
+}
+
+// Asks a y/N question on the terminal before a destructive step. -yes answers
+// for the user; with no terminal to ask on, the answer is no.
+func confirmAction(question string) bool {
+	if *assumeYes {
+		return true
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		log.Printf("%s Not confirmed: stdin is not a terminal (pass -yes to run unattended)", question)
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// Converts a path under the output directory to the form stored in the manifest:
+// relative to the output directory and always using forward slashes, so manifests
+// written on Windows and Unix agree
+func recordedPath(outputDir string, path string) string {
+	relative, err := filepath.Rel(outputDir, path)
+	if err != nil {
+		relative = path
+	}
+	return filepath.ToSlash(relative)
+}
+
+// Record of one downloaded file
+type manifestEntry struct {
+	URL          string    `json:"url"`                // Source URL of the file
+	Source       string    `json:"source,omitempty"`   // Product page that linked the file
+	Product      string    `json:"product,omitempty"`  // Product name scraped from that page
+	List         string    `json:"list,omitempty"`     // -urls or -slugs file the page or URL came from
+	Path         string    `json:"path"`               // Portable path relative to the output directory
+	Size         int64     `json:"size"`               // Size in bytes
+	SHA256       string    `json:"sha256"`             // Hex-encoded content digest
+	Identity     string    `json:"identity,omitempty"` // ETag, or Last-Modified and size, the server sent with the file
+	Aliases      []string  `json:"aliases,omitempty"`  // Other URLs -head-dedupe found serving the same document
+	Bundle       string    `json:"bundle,omitempty"`   // Zip bundle an -extract-zips entry came from; URL is then bundle#entry
+	DownloadedAt time.Time `json:"downloaded_at"`      // When the file was saved
+}
+
+// Index of every file in the output directory, persisted as JSON
+type manifest struct {
+	mutex   sync.Mutex               // Guards Entries while downloads run concurrently
+	path    string                   // File the manifest is stored in
+	Version string                   `json:"version,omitempty"` // Build that last wrote the manifest
+	Entries map[string]manifestEntry `json:"entries"`           // Keyed by recorded path
+}
+
+// Loads the manifest from disk, starting an empty one if it doesn't exist yet
+func loadManifest(path string) *manifest {
+	records := &manifest{path: path, Entries: make(map[string]manifestEntry)}
+	if !fileExists(path) {
+		return records
+	}
+	if err := json.Unmarshal([]byte(readAFileAsString(path)), records); err != nil {
+		log.Printf("Ignoring unreadable manifest %s: %v", path, err)
+	}
+	if records.Entries == nil {
+		records.Entries = make(map[string]manifestEntry)
+	}
+	return records
+}
+
+// Records a file saved under the output directory, filling in its path, size, digest and time.
+// Reports whether it replaced an entry for the same path with different content.
+func (records *manifest) add(ctx context.Context, entry manifestEntry, outputDir string, filePath string) bool {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		logf(ctx, "%v", err)
+		return false
+	}
+	digest, err := fileSHA256(filePath)
+	if err != nil {
+		logf(ctx, "%v", err)
+		return false
+	}
+	entry.Path = recordedPath(outputDir, filePath)
+	entry.Size = info.Size()
+	entry.SHA256 = digest
+	entry.DownloadedAt = time.Now().UTC()
+	records.mutex.Lock()
+	defer records.mutex.Unlock()
+	previous, existed := records.Entries[entry.Path]
+	if existed { // Aliases outlive re-downloads of the same file
+		entry.Aliases = previous.Aliases
+	}
+	records.Entries[entry.Path] = entry
+	return existed && previous.SHA256 != digest
+}
+
+// Returns the recorded path of a file with the given remote identity, or "" if there is none
+func (records *manifest) withIdentity(identity string) string {
+	records.mutex.Lock()
+	defer records.mutex.Unlock()
+	for recorded, entry := range records.Entries {
+		if entry.Identity == identity {
+			return recorded
+		}
+	}
+	return ""
+}
+
+// Notes another URL that serves the file recorded at a path
+func (records *manifest) addAlias(recorded string, uri string) {
+	records.mutex.Lock()
+	defer records.mutex.Unlock()
+	entry := records.Entries[recorded]
+	if entry.URL == uri || slices.Contains(entry.Aliases, uri) {
+		return
+	}
+	entry.Aliases = append(entry.Aliases, uri)
+	records.Entries[recorded] = entry
+}
+
+// Returns the recorded path of a URL's download, or "" if there is none
+func (records *manifest) pathFor(uri string) string {
+	records.mutex.Lock()
+	defer records.mutex.Unlock()
+	for recorded, entry := range records.Entries {
+		if entry.URL == uri {
+			return recorded
+		}
+	}
+	return ""
+}
+
+// Drops the entry recorded for a path
+func (records *manifest) remove(recorded string) {
+	records.mutex.Lock()
+	defer records.mutex.Unlock()
+	delete(records.Entries, recorded)
+}
+
+// Returns the set of URLs with a recorded download
+func (records *manifest) urls() map[string]bool {
+	records.mutex.Lock()
+	defer records.mutex.Unlock()
+	known := make(map[string]bool, len(records.Entries))
+	for _, entry := range records.Entries {
+		known[entry.URL] = true
+		if entry.Bundle != "" { // Extracted from a bundle downloaded by an earlier run
+			known[entry.Bundle] = true
+		}
+	}
+	return known
+}
+
+// Returns the entry recorded for a path, if any
+func (records *manifest) lookup(recorded string) manifestEntry {
+	records.mutex.Lock()
+	defer records.mutex.Unlock()
+	return records.Entries[recorded]
+}
+
+// Writes the manifest to disk
+func (records *manifest) save() {
+	records.mutex.Lock()
+	records.Version = versionString()
+	encoded, err := json.MarshalIndent(records, "", "  ")
+	records.mutex.Unlock()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	temporaryPath := records.path + ".tmp" // A crash or full disk mid-write never truncates the manifest
+	if err := os.WriteFile(temporaryPath, append(encoded, '\n'), fileMode); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.Rename(temporaryPath, records.path); err != nil {
+		log.Println(err)
+	}
+}
+
+// Concurrency-safe set of discovered PDF URLs that dedupes on insert, keeps
+// discovery order, and remembers the product pages referencing each URL
+type urlSet struct {
+	mutex sync.Mutex
+	order []string            // URLs in discovery order
+	pages map[string][]string // Referring product pages per URL, without repeats
+}
+
+// Creates an empty URL set
+func newURLSet() *urlSet {
+	return &urlSet{pages: make(map[string][]string)}
+}
+
+// Adds a URL found on a page ("" when it was not found on a page); reports whether the URL is new
+func (set *urlSet) add(uri string, page string) bool {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	pages, seen := set.pages[uri]
+	if !seen {
+		set.order = append(set.order, uri)
+	}
+	if page != "" && !slices.Contains(pages, page) {
+		pages = append(pages, page)
+	}
+	set.pages[uri] = pages
+	return !seen
+}
+
+// Returns the URLs in discovery order
+func (set *urlSet) list() []string {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	return slices.Clone(set.order)
+}
+
+// Returns the product pages referencing a URL
+func (set *urlSet) referrers(uri string) []string {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	return set.pages[uri]
+}
+
+// Returns a copy of the URL to referring pages map; URLs without a referring page are left out
+func (set *urlSet) references() map[string][]string {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	references := make(map[string][]string, len(set.pages))
+	for uri, pages := range set.pages {
+		if len(pages) > 0 {
+			references[uri] = slices.Clone(pages)
+		}
+	}
+	return references
+}
+
+// URLs that normalized to the same key, as written by -dedupe-report
+type dedupeGroup struct {
+	Kind string   `json:"kind"` // product_page or pdf
+	Key  string   `json:"key"`  // Normalized URL
+	URLs []string `json:"urls"` // Distinct spellings in the order found; the first one is used
+}
+
+// Records the distinct spellings seen for each normalized URL
+type dedupeTracker struct {
+	keys      []string            // Keys in the order first seen
+	spellings map[string][]string // Distinct spellings per key
+}
+
+// Creates an empty tracker
+func newDedupeTracker() *dedupeTracker {
+	return &dedupeTracker{spellings: make(map[string][]string)}
+}
+
+// Records that spelling normalized to key
+func (tracker *dedupeTracker) add(key string, spelling string) {
+	spellings, seen := tracker.spellings[key]
+	if !seen {
+		tracker.keys = append(tracker.keys, key)
+	}
+	if !slices.Contains(spellings, spelling) {
+		tracker.spellings[key] = append(spellings, spelling)
+	}
+}
+
+// Returns the keys that more than one spelling collapsed into
+func (tracker *dedupeTracker) groups(kind string) []dedupeGroup {
+	var groups []dedupeGroup
+	for _, key := range tracker.keys {
+		if spellings := tracker.spellings[key]; len(spellings) > 1 {
+			groups = append(groups, dedupeGroup{Kind: kind, Key: key, URLs: spellings})
+		}
+	}
+	return groups
+}
+
+// Writes the collapsed URL groups as JSON
+func writeDedupeReport(path string, groups []dedupeGroup) {
+	if groups == nil {
+		groups = []dedupeGroup{} // An empty array rather than null
+	}
+	encoded, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.WriteFile(path, append(encoded, '\n'), fileMode); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Wrote %d group(s) of collapsed URLs to %s", len(groups), path)
+}
+
+// Writes the map of PDF URL to referring product pages as JSON
+func writeReferencesFile(path string, references map[string][]string) {
+	encoded, err := json.MarshalIndent(references, "", "  ") // Map keys are written sorted
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.WriteFile(path, append(encoded, '\n'), fileMode); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Wrote references for %d PDF(s) to %s", len(references), path)
+}
+
+// Revision number in a PDF filename, e.g. "v2", "rev_3" or "version 1.4"
+var filenameVersionPattern = regexp.MustCompile(`(?i)(?:^|[^a-z])(?:version|ver|rev|v|r)[ ._-]?(\d+(?:\.\d+)*)`)
+
+// Returns the revision number in a PDF's filename as its numeric parts, or nil
+func filenameVersion(uri string) []int {
+	match := filenameVersionPattern.FindStringSubmatch(getFilename(uri))
+	if match == nil {
+		return nil
+	}
+	var parts []int
+	for _, part := range strings.Split(match[1], ".") {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return nil
+		}
+		parts = append(parts, number)
+	}
+	return parts
+}
+
+// Asks the server when a PDF was last modified; zero when it does not say
+func (downloader *Downloader) headLastModified(ctx context.Context, uri string) time.Time {
+	request, err := newRequest(ctx, http.MethodHead, uri)
+	if err != nil {
+		debugf(ctx, "%v", err)
+		return time.Time{}
+	}
+	response, err := sendRequest(downloader.Client, request)
+	if err != nil {
+		debugf(ctx, "%v", err)
+		return time.Time{}
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		debugf(ctx, "HEAD %s: %s", uri, response.Status)
+		return time.Time{}
+	}
+	modified, err := http.ParseTime(response.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}
+	}
+	return modified
+}
+
+// Picks the newest of several PDFs: the latest Last-Modified from a HEAD request
+// when every candidate reports one, otherwise the highest version in the filename.
+// Returns "" when neither tells them apart. HEAD results are kept in modified.
+func (downloader *Downloader) newestDocument(ctx context.Context, urls []string, modified map[string]time.Time) string {
+	for _, uri := range urls {
+		if _, checked := modified[uri]; !checked {
+			modified[uri] = downloader.headLastModified(ctx, uri)
+		}
+	}
+	if newest := uniqueMax(urls, func(a, b string) int {
+		return modified[a].Compare(modified[b])
+	}, func(uri string) bool { return !modified[uri].IsZero() }); newest != "" {
+		return newest
+	}
+	return uniqueMax(urls, func(a, b string) int {
+		return slices.Compare(filenameVersion(a), filenameVersion(b))
+	}, func(uri string) bool { return filenameVersion(uri) != nil })
+}
+
+// Returns the single greatest URL by compare, or "" when any URL is not known
+// (per known) or the greatest value is shared
+func uniqueMax(urls []string, compare func(a, b string) int, known func(string) bool) string {
+	best, tied := "", false
+	for _, uri := range urls {
+		if !known(uri) {
+			return ""
+		}
+		switch {
+		case best == "" || compare(uri, best) > 0:
+			best, tied = uri, false
+		case compare(uri, best) == 0:
+			tied = true
+		}
+	}
+	if tied {
+		return ""
+	}
+	return best
+}
+
+// Keeps only the newest PDF of each product page for -latest-only, preserving
+// order. PDFs not found on any page, and any PDF that is newest on some page, are kept.
+func (downloader *Downloader) latestOnly(ctx context.Context, urls []string, references map[string][]string) []string {
+	var pages []string
+	byPage := make(map[string][]string)
+	for _, uri := range urls {
+		for _, page := range references[uri] {
+			if _, seen := byPage[page]; !seen {
+				pages = append(pages, page)
+			}
+			byPage[page] = append(byPage[page], uri)
+		}
+	}
+	modified := make(map[string]time.Time)
+	chosen := make(map[string]bool)
+	older := make(map[string]bool)
+	for _, page := range pages {
+		candidates := byPage[page]
+		if len(candidates) == 1 {
+			chosen[candidates[0]] = true
+			continue
+		}
+		newest := downloader.newestDocument(ctx, candidates, modified)
+		if newest == "" { // Nothing to go on; download them all as before
+			logf(ctx, "Latest only: cannot tell which of %d PDF(s) on %s is newest; keeping all", len(candidates), page)
+			for _, uri := range candidates {
+				chosen[uri] = true
+			}
+			continue
+		}
+		chosen[newest] = true
+		logf(ctx, "Latest only: chose %s on %s", newest, page)
+		for _, uri := range candidates {
+			if uri != newest {
+				older[uri] = true
+				logf(ctx, "Latest only: skipping older %s", uri)
+			}
+		}
+	}
+	var kept []string
+	for _, uri := range urls {
+		if older[uri] && !chosen[uri] {
+			continue
+		}
+		kept = append(kept, uri)
+	}
+	return kept
+}
+
+// Parses a byte count such as 2MB, 512KB, 1.5GiB or 1048576. Decimal (KB, MB, GB)
+// and binary (KiB, MiB, GiB) units are accepted; a bare number is bytes.
+func parseByteSize(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1},
+	}
+	trimmed := strings.TrimSpace(value)
+	multiplier := 1.0
+	for _, unit := range units {
+		if len(trimmed) > len(unit.suffix) && strings.EqualFold(trimmed[len(trimmed)-len(unit.suffix):], unit.suffix) {
+			trimmed = strings.TrimSpace(trimmed[:len(trimmed)-len(unit.suffix)])
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 2MB, 512KB or a byte count)", value)
+	}
+	return int64(number * multiplier), nil
+}
+
+// Token bucket on bytes shared by every download, so -max-bandwidth holds in aggregate.
+// Up to one second's worth of bytes can be spent in a burst.
+type bandwidthLimiter struct {
+	mutex  sync.Mutex
+	rate   float64   // Bytes per second
+	tokens float64   // Bytes that may be read without waiting; negative when overdrawn
+	last   time.Time // When tokens was last topped up
+}
+
+// Shared limiter; nil when -max-bandwidth is not set
+var bandwidth *bandwidthLimiter
+
+// Takes n bytes from the bucket, sleeping until the rate allows them
+func (limiter *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	limiter.mutex.Lock()
+	now := time.Now()
+	limiter.tokens = min(limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate, limiter.rate)
+	limiter.last = now
+	limiter.tokens -= float64(n) // Reserve now so concurrent readers queue up behind each other
+	var delay time.Duration
+	if limiter.tokens < 0 {
+		delay = time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	}
+	limiter.mutex.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader whose throughput is paced by the shared bandwidth limiter
+type throttledReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (throttled throttledReader) Read(p []byte) (int, error) {
+	if limit := max(int(bandwidth.rate/10), 512); len(p) > limit { // Small reads keep the pacing smooth
+		p = p[:limit]
+	}
+	n, err := throttled.reader.Read(p)
+	if n > 0 {
+		if waitErr := bandwidth.wait(throttled.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// Wraps a response body with the -max-bandwidth limit, if one is set
+func limitBandwidth(ctx context.Context, reader io.Reader) io.Reader {
+	if bandwidth == nil {
+		return reader
+	}
+	return throttledReader{ctx: ctx, reader: reader}
+}
+
+// Delay added before the first request once the error rate crosses the threshold
+const throttleStep = 500 * time.Millisecond
+
+// Adaptive slowdown: tracks whether recent requests failed and, while the error
+// rate is at or above the threshold, delays each request, doubling the delay on
+// every further error and halving it on each success once the rate drops below it.
+type errorThrottle struct {
+	mutex    sync.Mutex
+	outcomes []bool        // Ring buffer of recent results; true means the request failed
+	next     int           // Position the next outcome is written to
+	filled   int           // Number of valid entries in outcomes
+	delay    time.Duration // Current delay before each request
+}
+
+// Shared by every request so all workers back off together
+var throttle = &errorThrottle{}
+
+// Returns how long to wait before the next request
+func (limiter *errorThrottle) wait() time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.delay
+}
+
+// Records the outcome of a request and adjusts the delay
+func (limiter *errorThrottle) record(ctx context.Context, failed bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if len(limiter.outcomes) != max(*throttleWindow, 1) { // Sized lazily once flags are parsed
+		limiter.outcomes = make([]bool, max(*throttleWindow, 1))
+	}
+	limiter.outcomes[limiter.next] = failed
+	limiter.next = (limiter.next + 1) % len(limiter.outcomes)
+	limiter.filled = min(limiter.filled+1, len(limiter.outcomes))
+	failures := 0
+	for index := 0; index < limiter.filled; index++ {
+		if limiter.outcomes[index] {
+			failures++
+		}
+	}
+	rate := float64(failures) / float64(limiter.filled)
+	previous := limiter.delay
+	switch {
+	case failed && rate >= *throttleThreshold: // Origin is struggling; back off further
+		limiter.delay = min(max(limiter.delay*2, throttleStep), *throttleMaxDelay)
+	case !failed && rate < *throttleThreshold: // Recover gradually as requests succeed again
+		limiter.delay /= 2
+		if limiter.delay < throttleStep/4 {
+			limiter.delay = 0
+		}
+	}
+	if previous == 0 && limiter.delay > 0 {
+		logf(ctx, "Error rate %.0f%% over the last %d request(s); slowing down", rate*100, limiter.filled)
+	} else if previous > 0 && limiter.delay == 0 {
+		logf(ctx, "Error rate back to %.0f%%; no longer slowing down", rate*100)
+	}
+}
+
+// Parses a Retry-After header in either delay-seconds or HTTP-date form
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// Sends a request with the given client, politely waiting out 429 Too Many Requests
+// responses for as long as Retry-After asks (capped by -max-retry-after)
+func sendRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if *throttleOnError {
+			if delay := throttle.wait(); delay > 0 { // Give a struggling origin room to recover
+				debugf(req.Context(), "Throttling %s for %s", req.URL, delay)
+				select {
+				case <-time.After(delay):
+				case <-req.Context().Done():
+					return nil, req.Context().Err()
+				}
+			}
+		}
+		resp, err := client.Do(req)
+		if label, traced := req.Context().Value(traceKey{}).(string); traced { // Finish the -trace with the outcome
+			if err != nil {
+				logf(req.Context(), "TRACE %s: failed: %v", label, err)
+			} else {
+				logf(req.Context(), "TRACE %s: < %s %s from %s", label, resp.Proto, resp.Status, resp.Request.URL)
+				keys := make([]string, 0, len(resp.Header))
+				for key := range resp.Header {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					logf(req.Context(), "TRACE %s: < %s: %s", label, key, strings.Join(resp.Header[key], ", "))
+				}
+			}
+		}
+		if *throttleOnError && req.Context().Err() == nil { // Cancellation says nothing about the server
+			throttle.record(req.Context(), err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500)
+		}
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= max429Retries {
+			return resp, err
+		}
+		if !retries.take() { // Bound the load a bad day puts on the origin
+			logf(req.Context(), "Retry budget exhausted; not retrying %s", req.URL)
+			return resp, err
+		}
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		resp.Body.Close() // The 429 body is not needed
+		if !ok {
+			wait = defaultRetryAfter
+		}
+		if wait > *maxRetryAfter { // Avoid pathological multi-hour sleeps
+			logf(req.Context(), "Retry-After of %s from %s exceeds -max-retry-after; waiting %s", wait, req.URL.Host, *maxRetryAfter)
+			wait = *maxRetryAfter
+		}
+		logf(req.Context(), "Rate limited by %s (429); retrying %s in %s", req.URL.Host, req.URL, wait)
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done(): // Stop waiting when the run is cancelled
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// Outcome counts for a run
+type runSummary struct {
+	Downloaded   int              `json:"downloaded"`    // Files saved this run
+	Skipped      int              `json:"skipped"`       // Files already on disk or completed earlier
+	Changed      int              `json:"changed"`       // Downloads that replaced a file with different content
+	Replaced     int              `json:"replaced"`      // Files -no-skip-existing replaced because the content differed
+	Unchanged    int              `json:"unchanged"`     // Files -no-skip-existing downloaded again and kept, as the content was the same
+	Failed       int              `json:"failed"`        // Downloads that failed
+	Pending      int              `json:"pending"`       // URLs not processed because the run stopped early
+	DeadPages    int              `json:"dead_pages"`    // Product pages that matched a -soft-404-marker
+	Retries      int              `json:"retries"`       // Extra attempts taken from the retry budget
+	Mismatched   int              `json:"mismatched"`    // Downloads whose digest differs from -expected-hashes
+	Unpinned     int              `json:"unpinned"`      // Downloads with no -expected-hashes entry
+	Aliases      int              `json:"aliases"`       // URLs -head-dedupe skipped as copies of a saved file
+	Failures     []failedDownload `json:"failures"`      // Each failed download and the product pages linking it
+	ChangedFiles []string         `json:"changed_files"` // Files counted in Changed, as recorded in the manifest
+	Bytes        int64            `json:"bytes"`         // Document bytes received
+	Elapsed      time.Duration    `json:"elapsed"`       // Wall-clock duration of the run
+	Version      string           `json:"version"`       // Build that performed the run
+}
+
+// A failed download and where it was linked from, for finding the broken product page
+type failedDownload struct {
+	URL   string   `json:"url"`
+	Pages []string `json:"pages,omitempty"` // Product pages linking the URL; none for URLs listed directly
+	Error string   `json:"error"`
+}
+
+// Time spent in each phase of the run, for -timings
+type phaseTimings struct {
+	Scrape   time.Duration // Fetching product pages
+	Extract  time.Duration // Parsing pages for metadata and links, resolving and deduplicating them
+	Download time.Duration // Downloading the PDFs
+	Pages    int           // Product pages fetched
+	URLs     int           // Distinct PDF URLs found
+}
+
+// Logs the time per phase with the amount of work done in each
+func (timings phaseTimings) print(summary runSummary) {
+	log.Printf("Timings: scrape %s (%d page(s)), extract+dedupe %s (%d URL(s)), download %s (%d downloaded, %d skipped, %d failed)",
+		timings.Scrape.Round(time.Millisecond), timings.Pages,
+		timings.Extract.Round(time.Millisecond), timings.URLs,
+		timings.Download.Round(time.Millisecond), summary.Downloaded, summary.Skipped, summary.Failed)
+}
+
+// Returns the -soft-404-marker found in a page, or "" if there is none
+func soft404Marker(page string, markers []string) string {
+	lower := strings.ToLower(page)
+	for _, marker := range markers {
+		if marker != "" && strings.Contains(lower, strings.ToLower(marker)) {
+			return marker
+		}
+	}
+	return ""
+}
+
+// Logs the product pages that looked like soft 404s so stale entries can be removed from the URL list
+func reportDeadPages(pages []string) {
+	if len(pages) == 0 {
+		return
+	}
+	log.Printf("%d product page(s) look dead (soft 404):", len(pages))
+	for _, page := range pages {
+		log.Printf("  %s", page)
+	}
+}
+
+// Describes the product pages a document was linked from, for log lines; "" when there are none
+func linkedFrom(pages []string) string {
+	if len(pages) == 0 {
+		return ""
+	}
+	return " (linked from " + strings.Join(pages, ", ") + ")"
+}
+
+// Logs the failed downloads with the product pages that link them, so broken links can be traced to their page
+func reportFailures(failures []failedDownload) {
+	if len(failures) == 0 {
+		return
+	}
+	log.Printf("%d download(s) failed:", len(failures))
+	for _, failure := range failures {
+		log.Printf("  %s%s: %s", failure.URL, linkedFrom(failure.Pages), failure.Error)
+	}
+}
+
+// Logs the documents whose content changed, for -poll cycles
+func reportChanges(files []string) {
+	if len(files) == 0 {
+		log.Println("No documents changed")
+		return
+	}
+	log.Printf("%d document(s) changed:", len(files))
+	for _, file := range files {
+		log.Printf("  %s", file)
+	}
+}
+
+// Logs the run summary
+func (summary runSummary) print() {
+	log.Printf("Summary: %s [%s]", summary, summary.Version)
+}
+
+// Describes the counts in one line
+func (summary runSummary) String() string {
+	description := fmt.Sprintf("%d downloaded, %d changed, %d skipped, %d failed, %d pending in %s",
+		summary.Downloaded, summary.Changed, summary.Skipped, summary.Failed, summary.Pending, summary.Elapsed.Round(time.Millisecond))
+	if summary.DeadPages > 0 {
+		description += fmt.Sprintf("; %d dead product page(s)", summary.DeadPages)
+	}
+	if *noSkipExisting {
+		description += fmt.Sprintf("; %d replaced, %d unchanged", summary.Replaced, summary.Unchanged)
+	}
+	if summary.Aliases > 0 {
+		description += fmt.Sprintf("; %d alias(es) of saved files", summary.Aliases)
+	}
+	if summary.Mismatched > 0 || summary.Unpinned > 0 {
+		description += fmt.Sprintf("; %d hash mismatch(es), %d new", summary.Mismatched, summary.Unpinned)
+	}
+	if byteCap > 0 {
+		description += fmt.Sprintf("; %s of the %s cap downloaded", formatBytes(summary.Bytes), formatBytes(byteCap))
+	}
+	if retries.limit > 0 {
+		description += fmt.Sprintf("; %d of %d retries used", summary.Retries, retries.limit)
+	} else if summary.Retries > 0 {
+		description += fmt.Sprintf("; %d retries", summary.Retries)
+	}
+	return description
+}
+
+// Body POSTed to -webhook; "text" is what Slack incoming webhooks display
+type webhookPayload struct {
+	Text           string  `json:"text"`
+	Status         string  `json:"status"` // completed, stopped or failed
+	New            int     `json:"new"`
+	Changed        int     `json:"changed"`
+	Skipped        int     `json:"skipped"`
+	Failed         int     `json:"failed"`
+	Pending        int     `json:"pending"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Error          string  `json:"error,omitempty"`
+	Version        string  `json:"version"`
+}
+
+// Version of the -summary-file layout; bump it when fields change meaning or are removed
+const summarySchemaVersion = 1
+
+// The -summary-file contents
+type summaryReport struct {
+	SchemaVersion  int              `json:"schema_version"`
+	Status         string           `json:"status"` // completed, stopped or failed
+	Downloaded     int              `json:"downloaded"`
+	Changed        int              `json:"changed"`
+	Skipped        int              `json:"skipped"`
+	Failed         int              `json:"failed"`
+	Pending        int              `json:"pending"`
+	DeadPages      int              `json:"dead_pages"`
+	Mismatched     int              `json:"mismatched,omitempty"`
+	Unpinned       int              `json:"unpinned,omitempty"`
+	Aliases        int              `json:"aliases,omitempty"`
+	Replaced       int              `json:"replaced,omitempty"`
+	Unchanged      int              `json:"unchanged,omitempty"`
+	Failures       []failedDownload `json:"failures,omitempty"`
+	Retries        int              `json:"retries"`
+	RetryBudget    int64            `json:"retry_budget,omitempty"`
+	StartedAt      string           `json:"started_at"`
+	ElapsedSeconds float64          `json:"elapsed_seconds"`
+	Error          string           `json:"error,omitempty"`
+	Version        string           `json:"version"`
+}
+
+// Writes the run outcome to -summary-file for whatever picks it up after the run
+func writeSummaryFile(status string, summary runSummary, runErr error) {
+	if *summaryFile == "" {
+		return
+	}
+	report := summaryReport{
+		SchemaVersion:  summarySchemaVersion,
+		Status:         status,
+		Downloaded:     summary.Downloaded,
+		Changed:        summary.Changed,
+		Skipped:        summary.Skipped,
+		Failed:         summary.Failed,
+		Pending:        summary.Pending,
+		DeadPages:      summary.DeadPages,
+		Mismatched:     summary.Mismatched,
+		Unpinned:       summary.Unpinned,
+		Aliases:        summary.Aliases,
+		Replaced:       summary.Replaced,
+		Unchanged:      summary.Unchanged,
+		Failures:       summary.Failures,
+		Retries:        summary.Retries,
+		RetryBudget:    retries.limit,
+		StartedAt:      startTime.UTC().Format(time.RFC3339),
+		ElapsedSeconds: summary.Elapsed.Seconds(),
+		Version:        versionString(),
+	}
+	if runErr != nil {
+		report.Error = runErr.Error()
+	}
+	encoded, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	temporaryPath := *summaryFile + ".tmp" // Readers never see a half-written summary
+	if err := os.WriteFile(temporaryPath, append(encoded, '\n'), fileMode); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.Rename(temporaryPath, *summaryFile); err != nil {
+		log.Println(err)
+	}
+}
+
+// Posts the run outcome to -webhook. Failures are logged and never end the run.
+func notifyWebhook(client *http.Client, status string, summary runSummary, runErr error) {
+	if *webhookURL == "" {
+		return
+	}
+	payload := webhookPayload{
+		Text:           "nclonline-com-documentation run " + status + ": " + summary.String(),
+		Status:         status,
+		New:            summary.Downloaded,
+		Changed:        summary.Changed,
+		Skipped:        summary.Skipped,
+		Failed:         summary.Failed,
+		Pending:        summary.Pending,
+		ElapsedSeconds: summary.Elapsed.Seconds(),
+		Version:        versionString(),
+	}
+	if runErr != nil {
+		payload.Text = "nclonline-com-documentation run " + status + " (" + runErr.Error() + "): " + summary.String()
+		payload.Error = runErr.Error()
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second) // The run's own deadline may have passed
+	defer cancel()
+	// Built here rather than by newRequest so GetBody is set and a 307 or 308 can be followed
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *webhookURL, bytes.NewReader(encoded))
+	if err != nil {
+		log.Printf("Webhook notification failed: %v", err)
+		return
+	}
+	req.Header.Set("User-Agent", nextUserAgent())
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Webhook notification failed: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Webhook notification failed: %s", resp.Status)
+	}
+}
+
+// Lockfile held by this run, if any, and its open handle, which carries the OS lock
+var (
+	heldLock     string
+	heldLockFile *os.File
+)
+
+// Returned by lockFile when another process holds the lock
+var errLockHeld = errors.New("lock is held by another process")
+
+// Takes an OS advisory lock (flock, or LockFileEx on Windows) on the lockfile and
+// records this process's PID in it for the messages of other runs. The OS releases
+// the lock when its holder exits, so a crashed run never leaves a stale lock behind,
+// and the PID in the file is informational only. If another run holds the lock,
+// returns an error, or with wait polls until it is released or ctx ends.
+func acquireLock(ctx context.Context, lockPath string, wait bool) error {
+	waiting := false
+	for {
+		file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, fileMode)
+		if err != nil {
+			return err
+		}
+		err = lockFile(file)
+		if err == nil {
+			opened, statErr := file.Stat()
+			current, err := os.Stat(lockPath)
+			if statErr != nil || err != nil || !os.SameFile(opened, current) { // Removed by the previous holder as it released the lock
+				file.Close()
+				continue
+			}
+			file.Truncate(0)
+			file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+			heldLock, heldLockFile = lockPath, file
+			return nil
+		}
+		file.Close()
+		if !errors.Is(err, errLockHeld) {
+			return fmt.Errorf("locking %s: %w", lockPath, err)
+		}
+		owner := "unknown pid"
+		if content, err := os.ReadFile(lockPath); err == nil && strings.TrimSpace(string(content)) != "" {
+			owner = "pid " + strings.TrimSpace(string(content))
+		}
+		if !wait {
+			return fmt.Errorf("%s is held by another run (%s); wait for it to finish or use -wait-for-lock", lockPath, owner)
+		}
+		if !waiting {
+			log.Printf("Waiting for the run holding %s (%s) to finish", lockPath, owner)
+			waiting = true
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Removes the lockfile held by this run
+func releaseLock() {
+	if heldLock != "" {
+		os.Remove(heldLock) // Before unlocking, so a waiting run sees the removal and retries (fails harmlessly on Windows)
+		heldLockFile.Close()
+		heldLock, heldLockFile = "", nil
+	}
+}
+
+// Finalizes the -archive file and releases the lock; called on every way out of a
+// run, so the archive is complete even when the run stops early
+func finishRun() {
+	finishArchive()
+	releaseLock()
+}
+
+// Finalizes the -archive file, if one is open
+func finishArchive() {
+	if documentArchive == nil {
+		return
+	}
+	if err := documentArchive.close(); err != nil {
+		log.Println(err)
+	}
+	documentArchive = nil
+}
+
+// Logs a fatal error, reports it to -summary-file and -webhook and exits
+func fatal(err error) {
+	log.Println(err)
+	finishRun()
+	summary := runSummary{Elapsed: time.Since(startTime), Retries: int(retries.used.Load())}
+	writeSummaryFile("failed", summary, err)
+	notifyWebhook(httpClient, "failed", summary, err)
+	os.Exit(exitFatal)
+}
+
+// A scraped page stored in the on-disk HTTP cache
+type cachedPage struct {
+	URL          string    `json:"url"`                     // Page URL the entry is for
+	StoredAt     time.Time `json:"stored_at"`               // When the page was fetched
+	ExpiresAt    time.Time `json:"expires_at"`              // When the entry stops being fresh
+	ETag         string    `json:"etag,omitempty"`          // Validator sent back as If-None-Match
+	LastModified string    `json:"last_modified,omitempty"` // Validator sent back as If-Modified-Since
+	Body         string    `json:"body"`                    // Page content
+}
+
+// Returns the cache file for a URL
+func cachePath(cacheDir string, uri string) string {
+	digest := sha256.Sum256([]byte(uri))
+	return filepath.Join(cacheDir, hex.EncodeToString(digest[:])+".json")
+}
+
+// Loads the cached entry for a URL, if any
+func readCachedPage(cacheDir string, uri string) (cachedPage, bool) {
+	var page cachedPage
+	path := cachePath(cacheDir, uri)
+	if !fileExists(path) {
+		return page, false
+	}
+	if err := json.Unmarshal([]byte(readAFileAsString(path)), &page); err != nil || page.URL != uri {
+		return page, false
+	}
+	return page, true
+}
+
+// Deletes the cached entry for a URL
+func removeCachedPage(cacheDir string, uri string) {
+	if err := os.Remove(cachePath(cacheDir, uri)); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
+
+// Works out when a response stops being fresh from Cache-Control and Expires,
+// falling back to the configured TTL. Returns false when it must not be stored.
+func cacheExpiry(header http.Header, now time.Time, ttl time.Duration) (time.Time, bool) {
+	for _, directive := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-store":
+			return time.Time{}, false
+		case directive == "no-cache": // Must be revalidated before every use
+			return now, true
+		case strings.HasPrefix(directive, "max-age="):
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				return now.Add(time.Duration(seconds) * time.Second), true
+			}
+		}
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		return expires, true
+	}
+	return now.Add(ttl), true
+}
+
+// Stores a page in the cache
+func writeCachedPage(cacheDir string, page cachedPage) {
+	if err := os.MkdirAll(cacheDir, dirMode); err != nil {
+		log.Println(err)
+		return
+	}
+	encoded, err := json.Marshal(page)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.WriteFile(cachePath(cacheDir, page.URL), encoded, fileMode); err != nil {
+		log.Println(err)
+	}
+}
+
+// Layout of the -report-html index
+var reportTemplate = htmltemplate.Must(htmltemplate.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>NCL Safety Data Sheets</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; text-align: left; }
+td.size { text-align: right; }
+</style>
+</head>
+<body>
+<h1>NCL Safety Data Sheets</h1>
+<p>{{len .Rows}} document(s), generated {{.Generated}}.</p>
+<table>
+<tr><th>Product</th><th>File</th><th>Size</th><th>Downloaded</th></tr>
+{{range .Rows}}<tr><td>{{if .Source}}<a href="{{.Source}}">{{.Product}}</a>{{else}}{{.Product}}{{end}}</td><td><a href="{{.Path}}">{{.Path}}</a></td><td class="size">{{.Size}}</td><td>{{.Downloaded}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Formats a byte count for people
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	divisor, exponent := int64(unit), 0
+	for quotient := size / unit; quotient >= unit; quotient /= unit {
+		divisor *= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(divisor), "KMGTPE"[exponent])
+}
+
+// Writes index.html listing every file in the manifest with a link to it
+func writeHTMLReport(reportPath string, records *manifest) error {
+	type reportRow struct {
+		Product, Source, Path, Size, Downloaded string
+	}
+	var rows []reportRow
+	for _, entry := range records.Entries {
+		product := entry.Product
+		if product == "" && entry.Source != "" { // Fall back to the product slug
+			product = path.Base(entry.Source)
+		}
+		rows = append(rows, reportRow{
+			Product:    product,
+			Source:     entry.Source,
+			Path:       entry.Path,
+			Size:       formatBytes(entry.Size),
+			Downloaded: entry.DownloadedAt.Format("2006-01-02"),
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Product != rows[j].Product {
+			return rows[i].Product < rows[j].Product
+		}
+		return rows[i].Path < rows[j].Path
+	})
+	out, err := os.OpenFile(reportPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileMode)
 	if err != nil {
-		log.Println(err) // Log if request fails
+		return err
 	}
+	defer out.Close() // Ensure file is closed after writing
+	return reportTemplate.Execute(out, struct {
+		Rows      []reportRow
+		Generated string
+	}{rows, time.Now().Format("2006-01-02 15:04")})
+}
 
-	body, err := io.ReadAll(response.Body) // Read the body of the response
+// Performs HTTP GET request and returns response body as string. The error reports
+// a page that could not be fetched or did not answer 2xx, whose links are unknown.
+func (downloader *Downloader) getDataFromURL(ctx context.Context, uri string) (string, error) {
+	var cached cachedPage
+	var haveCached bool
+	if *httpCacheDir != "" { // Serve fresh pages from the on-disk cache
+		cached, haveCached = readCachedPage(*httpCacheDir, uri)
+		if haveCached && time.Now().Before(cached.ExpiresAt) {
+			logf(ctx, "Scraping (cached) %s", uri)
+			return cached.Body, nil
+		}
+	}
+	logf(ctx, "Scraping %s", uri)                        // Log which URL is being scraped
+	request, err := newRequest(ctx, http.MethodGet, uri) // Build GET request
+	if err != nil {
+		return "", err
+	}
+	if haveCached { // Revalidate the stale entry instead of refetching it outright
+		if cached.ETag != "" {
+			request.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			request.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	response, err := sendRequest(downloader.Client, request) // Send GET request
 	if err != nil {
-		log.Println(err) // Log read error
+		return "", err
+	}
+	if response.StatusCode == http.StatusNotModified && haveCached { // Unchanged; reuse the stored body
+		response.Body.Close()
+		logf(ctx, "Not modified %s", uri)
+		now := time.Now()
+		if expiresAt, cacheable := cacheExpiry(response.Header, now, *httpCacheTTL); cacheable {
+			if etag := response.Header.Get("ETag"); etag != "" { // Servers may rotate the validator on 304
+				cached.ETag = etag
+			}
+			cached.StoredAt, cached.ExpiresAt = now.UTC(), expiresAt.UTC()
+			writeCachedPage(*httpCacheDir, cached)
+		} else {
+			removeCachedPage(*httpCacheDir, uri)
+		}
+		return cached.Body, nil
 	}
 
+	body, readErr := io.ReadAll(response.Body)                        // Read the body of the response
+	body = decodeHTML(ctx, body, response.Header.Get("Content-Type")) // Work on UTF-8 whatever the page was served in
+
 	err = response.Body.Close() // Close response body
 	if err != nil {
-		log.Println(err) // Log error during close
+		logf(ctx, "%v", err) // Log error during close
+	}
+	if *httpCacheDir != "" && response.StatusCode == http.StatusOK && readErr == nil { // Keep successful pages for later runs
+		now := time.Now()
+		if expiresAt, cacheable := cacheExpiry(response.Header, now, *httpCacheTTL); cacheable {
+			writeCachedPage(*httpCacheDir, cachedPage{
+				URL:          uri,
+				StoredAt:     now.UTC(),
+				ExpiresAt:    expiresAt.UTC(),
+				ETag:         response.Header.Get("ETag"),
+				LastModified: response.Header.Get("Last-Modified"),
+				Body:         string(body),
+			})
+		} else if haveCached { // no-store: drop the entry we revalidated against
+			removeCachedPage(*httpCacheDir, uri)
+		}
+	}
+	if readErr != nil { // Cut off; the links on the rest of the page are unknown
+		return string(body), readErr
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return string(body), &BadStatusError{Code: response.StatusCode, Status: response.Status}
+	}
+	return string(body), nil // Return response body as string
+}
+
+// Converts a page to UTF-8 using the charset from the Content-Type header, a BOM or
+// a <meta charset> tag. A page that is valid UTF-8 and declares nothing in the header
+// is left as it is.
+func decodeHTML(ctx context.Context, body []byte, contentType string) []byte {
+	encoding, name, certain := charset.DetermineEncoding(body, contentType)
+	if name == "utf-8" || (!certain && utf8.Valid(body)) {
+		return body
+	}
+	decoded, err := encoding.NewDecoder().Bytes(body)
+	if err != nil {
+		logf(ctx, "Cannot decode page from %s: %v", name, err)
+		return body
+	}
+	debugf(ctx, "Decoded page from %s", name)
+	return decoded
+}
+
+// Wraps a page body in a reader that converts it to UTF-8, deciding as decodeHTML does
+// but from the first 1024 bytes only, since the rest has not arrived yet
+func decodingReader(ctx context.Context, body io.Reader, contentType string) io.Reader {
+	buffered := bufio.NewReaderSize(body, 1024)
+	preview, _ := buffered.Peek(1024) // Shorter for small pages; errors resurface on the next read
+	encoding, name, certain := charset.DetermineEncoding(preview, contentType)
+	if name == "utf-8" || (!certain && utf8.Valid(preview)) {
+		return buffered
+	}
+	debugf(ctx, "Decoding page from %s", name)
+	return encoding.NewDecoder().Reader(buffered)
+}
+
+// Fetches a product page for -stream-pages, extracting its PDF links while the body
+// downloads and appending the page to savePath as it goes, so the page is never held
+// in memory as a whole. Like getDataFromURL, the error reports a page whose links are unknown.
+func (downloader *Downloader) streamPDFUrls(ctx context.Context, uri string, savePath string) ([]string, error) {
+	logf(ctx, "Scraping (streamed) %s", uri)
+	request, err := newRequest(ctx, http.MethodGet, uri)
+	if err != nil {
+		return nil, err
+	}
+	response, err := sendRequest(downloader.Client, request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close() // Ensure body is closed after parsing
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, &BadStatusError{Code: response.StatusCode, Status: response.Status}
+	}
+	saved, err := os.OpenFile(savePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, fileMode)
+	if err != nil {
+		return nil, err
+	}
+	defer saved.Close() // Ensure file is closed after writing
+	if *htmlMarkers {
+		if _, err := saved.WriteString(pageMarker("BEGIN", uri) + "\n"); err != nil {
+			log.Println(err)
+		}
+	}
+	body := &readErrorRecorder{reader: response.Body}
+	page := decodingReader(ctx, body, response.Header.Get("Content-Type"))
+	links := extractPDFUrlsFrom(ctx, io.TeeReader(page, saved))
+	trailer := "\n" // Same layout as appendAndWriteToFile
+	if *htmlMarkers {
+		trailer = "\n" + pageMarker("END", uri) + "\n"
+	}
+	if _, err := saved.WriteString(trailer); err != nil {
+		log.Println(err)
+	}
+	return links, body.err // The tokenizer stops quietly on a cut-off body
+}
+
+// Remembers the first error other than io.EOF returned by the wrapped reader
+type readErrorRecorder struct {
+	reader io.Reader
+	err    error
+}
+
+func (recorder *readErrorRecorder) Read(buffer []byte) (int, error) {
+	count, err := recorder.reader.Read(buffer)
+	if err != nil && err != io.EOF && recorder.err == nil {
+		recorder.err = err
 	}
-	return string(body) // Return response body as string
+	return count, err
+}
+
+// Returns the comment that starts or ends a page in nclonline.html, e.g. <!-- BEGIN https://... -->.
+// "--" may not appear inside a comment, so it is percent-encoded in the URL.
+func pageMarker(kind string, pageURL string) string {
+	return "<!-- " + kind + " " + strings.ReplaceAll(pageURL, "--", "-%2D") + " -->"
 }
 
 // Append and write to file
 func appendAndWriteToFile(path string, content string) {
-	filePath, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	filePath, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, fileMode)
 	if err != nil {
 		log.Println(err)
 	}
@@ -238,6 +4310,161 @@ func appendAndWriteToFile(path string, content string) {
 	}
 }
 
+// Reads a -urls file: one URL per line, blank lines and # comments ignored.
+// Lines whose path ends in .pdf are returned separately as direct downloads. A file
+// that cannot be read is an error: scraping without it would look like a complete run.
+func loadURLList(path string) ([]string, []string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading -urls list: %w", err)
+	}
+	var pages, pdfs []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !isUrlValid(line) {
+			log.Printf("Ignoring invalid URL in %s: %s", path, line)
+			continue
+		}
+		if parsed, err := url.Parse(line); err == nil && strings.HasSuffix(strings.ToLower(parsed.Path), ".pdf") {
+			pdfs = append(pdfs, line)
+		} else {
+			pages = append(pages, line)
+		}
+	}
+	return pages, pdfs, nil
+}
+
+// Reads a list file such as -exclude-file or -slugs: one item per line, blank lines and # comments ignored.
+// Like loadURLList, a file that cannot be read is an error rather than an empty list.
+func readListFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading list: %w", err)
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+// Default -language-map: words that mark a document's language in its filename
+const defaultLanguageMap = "english=en,eng=en,en=en,spanish=es,espanol=es,español=es,es=es,french=fr,francais=fr,français=fr,fr=fr"
+
+// Parses a -language-map such as "english=en,spanish=es" into lowercase word → language
+func parseLanguageMap(value string) (map[string]string, error) {
+	languages := make(map[string]string)
+	for _, pair := range splitList(value) {
+		word, language, found := strings.Cut(pair, "=")
+		word, language = strings.ToLower(strings.TrimSpace(word)), strings.ToLower(strings.TrimSpace(language))
+		if !found || word == "" || language == "" {
+			return nil, fmt.Errorf("%q is not word=language", pair)
+		}
+		languages[word] = language
+	}
+	return languages, nil
+}
+
+// Returns the language of a document from the last word of its filename that the
+// map knows, e.g. en for 1_12_sds_english.pdf or fr for SDS_FR.pdf, or "" if none does
+func documentLanguage(uri string, languages map[string]string) string {
+	name := uri
+	if parsed, err := url.Parse(uri); err == nil {
+		name = path.Base(parsed.Path) // Unescaped, without the query string
+	}
+	words := strings.FieldsFunc(strings.ToLower(strings.TrimSuffix(strings.ToLower(name), ".pdf")), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for index := len(words) - 1; index >= 0; index-- {
+		if language, found := languages[words[index]]; found {
+			return language
+		}
+	}
+	return ""
+}
+
+// Checks whether a PDF URL or the filename derived from it matches any exclude pattern
+func (downloader *Downloader) isExcluded(uri string, patterns []string) bool {
+	filename := strings.ToLower(downloader.Sanitizer(uri))
+	lowerURI := strings.ToLower(uri)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if matched, _ := path.Match(pattern, filename); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, lowerURI); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetches one preflight page and checks it is the page asked for: 200 OK, HTML,
+// not redirected elsewhere (e.g. to a login), and for product pages, linking a PDF
+func (downloader *Downloader) checkPage(ctx context.Context, uri string) (string, error) {
+	request, err := newRequest(ctx, http.MethodGet, uri)
+	if err != nil {
+		return "", err
+	}
+	response, err := sendRequest(downloader.Client, request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", response.Status)
+	}
+	if final := response.Request.URL; final.Host != request.URL.Host || strings.TrimSuffix(final.Path, "/") != strings.TrimSuffix(request.URL.Path, "/") {
+		return "", fmt.Errorf("redirected to %s", final)
+	}
+	if contentType := response.Header.Get("Content-Type"); !strings.Contains(contentType, "text/html") {
+		return "", fmt.Errorf("content type %q is not HTML", contentType)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	links := extractPDFUrls(ctx, string(decodeHTML(ctx, body, response.Header.Get("Content-Type"))))
+	if strings.Contains(request.URL.Path, "/products/") && len(links) == 0 {
+		return "", errors.New("product page links no PDFs; the page layout may have changed")
+	}
+	return fmt.Sprintf("%s, %s, %d PDF link(s)", response.Status, formatBytes(int64(len(body))), len(links)), nil
+}
+
+// Expands product slugs into product page URLs under baseURL and prefix, dropping invalid ones
+func expandSlugs(slugs []string, prefix string) []string {
+	prefix = "/" + strings.Trim(prefix, "/") + "/"
+	if prefix == "//" { // Slugs directly under the site root
+		prefix = "/"
+	}
+	var pages []string
+	for _, slug := range slugs {
+		page := baseURL + prefix + url.PathEscape(strings.Trim(slug, "/"))
+		if !isUrlValid(page) {
+			log.Printf("Ignoring invalid slug %q", slug)
+			continue
+		}
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// Writes lines to a file, one per line, replacing any existing content
+func writeLines(path string, lines []string) error {
+	var content strings.Builder
+	for _, line := range lines {
+		content.WriteString(line + "\n")
+	}
+	return os.WriteFile(path, []byte(content.String()), fileMode)
+}
+
 // Read a file and return the contents
 func readAFileAsString(path string) string {
 	content, err := os.ReadFile(path)
@@ -247,277 +4474,1178 @@ func readAFileAsString(path string) string {
 	return string(content)
 }
 
+// Product pages scraped for SDS links when no -urls file is given
+var productPageURLs = []string{
+	"https://www.nclonline.com/products/sds_alpha",
+	"https://www.nclonline.com/products/view/15_COCONUT_OIL",
+	"https://www.nclonline.com/products/view/24_7_",
+	"https://www.nclonline.com/products/view/Afia_ALCOHOL_BASED",
+	"https://www.nclonline.com/products/view/Afia_Alcohol_Free",
+	"https://www.nclonline.com/products/view/Afia_Anti_Bacterial",
+	"https://www.nclonline.com/products/view/Afia_Earth_Sense_Certified_Green_Foaming",
+	"https://www.nclonline.com/products/view/Afia_Foaming_E2",
+	"https://www.nclonline.com/products/view/Afia_Foaming_Hair_and_Body_Wash",
+	"https://www.nclonline.com/products/view/Afia_Harvest_Melon",
+	"https://www.nclonline.com/products/view/Afia_Hypoallergenic_Certified",
+	"https://www.nclonline.com/products/view/Afia_Ocean_Mist",
+	"https://www.nclonline.com/products/view/Afia_Spring_Blossom",
+	"https://www.nclonline.com/products/view/ALL_IN_ONE_",
+	"https://www.nclonline.com/products/view/ALL_OFF_",
+	"https://www.nclonline.com/products/view/ASAP",
+	"https://www.nclonline.com/products/view/ASTRO_CHEM_",
+	"https://www.nclonline.com/products/view/AUTO_KLEEN_",
+	"https://www.nclonline.com/products/view/AVISTAT_D_",
+	"https://www.nclonline.com/products/view/BALANCE_",
+	"https://www.nclonline.com/products/view/BARE_BONES_",
+	"https://www.nclonline.com/products/view/BARE_BONES_LOW_ODOR",
+	"https://www.nclonline.com/products/view/BATHROOM_PLUS_",
+	"https://www.nclonline.com/products/view/BIG_PUNCH",
+	"https://www.nclonline.com/products/view/BLUE_VELVET_",
+	"https://www.nclonline.com/products/view/BOLT_",
+	"https://www.nclonline.com/products/view/BRITE_EYES_",
+	"https://www.nclonline.com/products/view/BULLSEYE_",
+	"https://www.nclonline.com/products/view/BURST_PLUS_",
+	"https://www.nclonline.com/products/view/C_ALL_",
+	"https://www.nclonline.com/products/view/CHEM_EEZ_",
+	"https://www.nclonline.com/products/view/CITRI_SCRUB_",
+	"https://www.nclonline.com/products/view/CITROL",
+	"https://www.nclonline.com/products/view/CITRUS_FLOWER_QUAT",
+	"https://www.nclonline.com/products/view/CITRUS_KLEEN",
+	"https://www.nclonline.com/products/view/CleanSMART_Foaming_Degreaser_Cleaner_SC",
+	"https://www.nclonline.com/products/view/CleanSMART_Pot_Pan_Detergent_SC",
+	"https://www.nclonline.com/products/view/CleanSMART_Sanitizer_1_512",
+	"https://www.nclonline.com/products/view/COMBAT_",
+	"https://www.nclonline.com/products/view/COMMAND_",
+	"https://www.nclonline.com/products/view/CONKLEEN_204_",
+	"https://www.nclonline.com/products/view/CORRAL_",
+	"https://www.nclonline.com/products/view/CREAM_COAT_",
+	"https://www.nclonline.com/products/view/CYCLONE_",
+	"https://www.nclonline.com/products/view/DECADE_",
+	"https://www.nclonline.com/products/view/DEO_PINE_",
+	"https://www.nclonline.com/products/view/DESCUM",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_1",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_10",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_11",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_17",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_19",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_2",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_20",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_21",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_22",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_23",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_24",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_25",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_26",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_3",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_4",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_5",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_6",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_7",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_8",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_9",
+	"https://www.nclonline.com/products/view/DURA_GLOSS_",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_ASPIRE_",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_Certified_Foaming_Hand_Cleaner",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_Certified_Liquid_Hand_Cleaner",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_Degreaser_Cleaner",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_EVERGREEN_FINISH",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_Extra_Heavy_Duty_RTU",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_Foam_Safe",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_GREEN_IMPACT_",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_HD_WASHROOM_CLEANER",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_Multi_Purpose_Neutral_Cleaner",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_Multi_Surface_Concentrate_with_H2O2",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_NEUTRAL_FLOOR_CLEANER",
+	"https://www.nclonline.com/products/view/EARTH_SENSE_RTU_GLASS_HARD_SURFACE_CLEANER",
+	"https://www.nclonline.com/products/view/EASY_DAB_",
+	"https://www.nclonline.com/products/view/ECO_SOLV",
+	"https://www.nclonline.com/products/view/EDGE_PLUS_",
+	"https://www.nclonline.com/products/view/ENDURE_",
+	"https://www.nclonline.com/products/view/ENHANCE_",
+	"https://www.nclonline.com/products/view/ENSEEL_",
+	"https://www.nclonline.com/products/view/ES_Neutral_Disinfectant_Detergent",
+	"https://www.nclonline.com/products/view/ETERNITY_",
+	"https://www.nclonline.com/products/view/ETERNITY_Aerosol_",
+	"https://www.nclonline.com/products/view/EXPOSE_",
+	"https://www.nclonline.com/products/view/EXTREME_PLUS_",
+	"https://www.nclonline.com/products/view/FLEXI_CLEAN",
+	"https://www.nclonline.com/products/view/FLEXI_SHEEN_",
+	"https://www.nclonline.com/products/view/FOAM_SAFE_OCEAN_MIST",
+	"https://www.nclonline.com/products/view/FOAM_BREAK_",
+	"https://www.nclonline.com/products/view/FORTRESS",
+	"https://www.nclonline.com/products/view/FRESH_START_",
+	"https://www.nclonline.com/products/view/GLIMMER_",
+	"https://www.nclonline.com/products/view/GOLDEN_POT_PAN",
+	"https://www.nclonline.com/products/view/GREEN_EMERALD",
+	"https://www.nclonline.com/products/view/HOMBRE_",
+	"https://www.nclonline.com/products/view/HURRAH_CAR_WASH",
+	"https://www.nclonline.com/products/view/HURRICANE_",
+	"https://www.nclonline.com/products/view/IMAGE_",
+	"https://www.nclonline.com/products/view/IMPRESSIONS_",
+	"https://www.nclonline.com/products/view/INCREDILOSO_",
+	"https://www.nclonline.com/products/view/INCREDILOSO_Lavender",
+	"https://www.nclonline.com/products/view/INVINCIBLE_",
+	"https://www.nclonline.com/products/view/KITCHEN_MATE",
+	"https://www.nclonline.com/products/view/KLEER_BRITE_",
+	"https://www.nclonline.com/products/view/LAVENDER_QUAT",
+	"https://www.nclonline.com/products/view/LEMON_QUAT",
+	"https://www.nclonline.com/products/view/LUSTER",
+	"https://www.nclonline.com/products/view/LVT_CLEAN",
+	"https://www.nclonline.com/products/view/LVT_PROTECT",
+	"https://www.nclonline.com/products/view/MAGIC_BREEZE_Herbal",
+	"https://www.nclonline.com/products/view/MAGIC_BREEZE_Lavender",
+	"https://www.nclonline.com/products/view/MAIN_SQUEEZE_CLEANER",
+	"https://www.nclonline.com/products/view/MAIN_SQUEEZE_DEGREASER",
+	"https://www.nclonline.com/products/view/MAIN_SQUEEZE_GLASS",
+	"https://www.nclonline.com/products/view/MAIN_SQUEEZE_Lavender_256",
+	"https://www.nclonline.com/products/view/MARVEL",
+	"https://www.nclonline.com/products/view/MATTE",
+	"https://www.nclonline.com/products/view/MICRO_CHEM_PLUS_",
+	"https://www.nclonline.com/products/view/MINT_QUAT",
+	"https://www.nclonline.com/products/view/MIRAGE",
+	"https://www.nclonline.com/products/view/MOLD_AWAY_",
+	"https://www.nclonline.com/products/view/MRP_",
+	"https://www.nclonline.com/products/view/MULTI_STAT_",
+	"https://www.nclonline.com/products/view/NATURAL_MIRACLE_",
+	"https://www.nclonline.com/products/view/NATURE_S_FORCE",
+	"https://www.nclonline.com/products/view/NATURE_S_POWER",
+	"https://www.nclonline.com/products/view/NATURE_S_SOLUTION_",
+	"https://www.nclonline.com/products/view/NCL_2_",
+	"https://www.nclonline.com/products/view/NCLwipes_Lemon_Fresh",
+	"https://www.nclonline.com/products/view/NCLwipes_Waterfall_Fresh",
+	"https://www.nclonline.com/products/view/NEUTRA_CIDE_256",
+	"https://www.nclonline.com/products/view/NEUTRAL_Q_",
+	"https://www.nclonline.com/products/view/NEXT_CENTURY_",
+	"https://www.nclonline.com/products/view/NEXT_STEP_",
+	"https://www.nclonline.com/products/view/NO_ZAP_STATIC_DISSIPATIVE_FLOOR_COATING",
+	"https://www.nclonline.com/products/view/NU_HIDE_",
+	"https://www.nclonline.com/products/view/NU_LOOK",
+	"https://www.nclonline.com/products/view/ONE_COAT_25_",
+	"https://www.nclonline.com/products/view/ONE_STEP_",
+	"https://www.nclonline.com/products/view/ONE_",
+	"https://www.nclonline.com/products/view/PATINA_",
+	"https://www.nclonline.com/products/view/PERFECTION_",
+	"https://www.nclonline.com/products/view/pH_ENOMENAL_",
+	"https://www.nclonline.com/products/view/PICTURE_PERFECT_",
+	"https://www.nclonline.com/products/view/PINE_QUAT_PLUS_",
+	"https://www.nclonline.com/products/view/PINK_LOTION",
+	"https://www.nclonline.com/products/view/PINK_N_CREAMY",
+	"https://www.nclonline.com/products/view/PINK_SUDS",
+	"https://www.nclonline.com/products/view/PIZZAZZ_",
+	"https://www.nclonline.com/products/view/POOFF_",
+	"https://www.nclonline.com/products/view/POP_SHINE_",
+	"https://www.nclonline.com/products/view/POP_SHINE_RTU",
+	"https://www.nclonline.com/products/view/PRO_SEEL_",
+	"https://www.nclonline.com/products/view/ProLEX_CDL_520",
+	"https://www.nclonline.com/products/view/ProLEX_HTR_260",
+	"https://www.nclonline.com/products/view/ProLEX_LTD_220",
+	"https://www.nclonline.com/products/view/ProLEX_LTR_250",
+	"https://www.nclonline.com/products/view/QWIK_SCRUB_",
+	"https://www.nclonline.com/products/view/RELY",
+	"https://www.nclonline.com/products/view/RINSE_AWAY_PLUS_",
+	"https://www.nclonline.com/products/view/ROAD_AWAY",
+	"https://www.nclonline.com/products/view/ROCK_HARD_",
+	"https://www.nclonline.com/products/view/RUFF_N_READY",
+	"https://www.nclonline.com/products/view/SANIQUAT",
+	"https://www.nclonline.com/products/view/SEA_BRITE_",
+	"https://www.nclonline.com/products/view/SHA_ZYME_",
+	"https://www.nclonline.com/products/view/SHA_ZYME_DRC",
+	"https://www.nclonline.com/products/view/SHA_ZYME_RTU",
+	"https://www.nclonline.com/products/view/SHIELD",
+	"https://www.nclonline.com/products/view/SOFT_N_CREAMY",
+	"https://www.nclonline.com/products/view/SPIT_SHINE_",
+	"https://www.nclonline.com/products/view/SPRAY_KLEEN_PLUS_",
+	"https://www.nclonline.com/products/view/SPRITZ_",
+	"https://www.nclonline.com/products/view/STAMINA_",
+	"https://www.nclonline.com/products/view/STONE_BEAUTY_",
+	"https://www.nclonline.com/products/view/STONE_KLEEN_",
+	"https://www.nclonline.com/products/view/SUN_SPRAY",
+	"https://www.nclonline.com/products/view/SUPER_CHERRY",
+	"https://www.nclonline.com/products/view/SUPER_NAC_",
+	"https://www.nclonline.com/products/view/SUPER_PURGE",
+	"https://www.nclonline.com/products/view/SUPER_SONIC_",
+	"https://www.nclonline.com/products/view/SURFACE_BARRIER_",
+	"https://www.nclonline.com/products/view/SURFACE_PREP_",
+	"https://www.nclonline.com/products/view/SURGE_",
+	"https://www.nclonline.com/products/view/TANNIN_OUT_",
+	"https://www.nclonline.com/products/view/TOTAL_",
+	"https://www.nclonline.com/products/view/TRIGGER_",
+	"https://www.nclonline.com/products/view/TWISTER_",
+	"https://www.nclonline.com/products/view/ULTRAMAX_",
+	"https://www.nclonline.com/products/view/UPPER_HAND_",
+	"https://www.nclonline.com/products/view/VIGOR_",
+	"https://www.nclonline.com/products/view/VISIONS_",
+	"https://www.nclonline.com/products/view/VIVID_",
+	"https://www.nclonline.com/products/view/WASH_BRITE_",
+	"https://www.nclonline.com/products/view/WHITE_PEARL",
+	"https://www.nclonline.com/products/view/WITHSTAND_",
+	"https://www.nclonline.com/products/view/WORLD_CLASS_",
+	"https://www.nclonline.com/products/view/WRANGLER_",
+	"https://www.nclonline.com/products/view/ZooooM_",
+	"https://www.nclonline.com/products/flyer_alpha.php",
+	"https://www.nclonline.com/products/view/Afia_Drip_Tray",
+	"https://www.nclonline.com/products/view/Afia_Floor_Dispenser_Stand_White",
+	"https://www.nclonline.com/products/view/Afia_Manual_Dispenser",
+	"https://www.nclonline.com/products/view/Afia_Touch_Free",
+	"https://www.nclonline.com/products/view/CleanSMART_Foam_Dispensing_Unit",
+	"https://www.nclonline.com/products/view/CleanSMART_Sink_Dispensing_Unit",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_Jr_",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_PORTABLE",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_PORTABLE_KIT",
+	"https://www.nclonline.com/products/view/DUAL_BLEND_WALL",
+	"https://www.nclonline.com/products/view/ECONO_DIAMONDS",
+	"https://www.nclonline.com/products/view/FOAM_MAGIC",
+	"https://www.nclonline.com/products/view/GRANITE_MASTER_",
+	"https://www.nclonline.com/products/view/HANDI_RACK_Round_Gallon_",
+	"https://www.nclonline.com/products/view/INDUSTRIAL_HAND_SOAP_DISPENSER",
+	"https://www.nclonline.com/products/view/LUMINAIRE_",
+	"https://www.nclonline.com/products/view/MECHANICS_SELECT_HAND_CARE_PUMP",
+	"https://www.nclonline.com/products/view/NAT_SPEED_",
+	"https://www.nclonline.com/products/view/NAT_SPLASH_GUARD",
+	"https://www.nclonline.com/products/view/NAT_STONE_Pad_Driver",
+	"https://www.nclonline.com/products/view/Pak_SMART_Cap",
+	"https://www.nclonline.com/products/view/PRO_SERIES_STONE_BLAZER_",
+	"https://www.nclonline.com/products/view/Refillable_Foaming_Hand_Cleaner_Dispener_Cartridge",
+	"https://www.nclonline.com/products/view/RSC_Foaming_Nozzle",
+	"https://www.nclonline.com/products/view/STONE_BLAZER_",
+	"https://www.nclonline.com/products/view/UNI_POWER_",
+	"https://www.nclonline.com/products/view/WET_CONCRETE_DIAMONDS",
+}
+
 func main() {
+	flag.Usage = usage
+	flag.Parse() // Parse command-line flags
+	if *printVersion {
+		fmt.Println("nclonline-com-documentation " + versionString())
+		return
+	}
+	*urlsFiles = urlListFiles(*urlsFiles, os.Getenv(urlsEnv)) // Lists provided by the environment join the run
+
+	// Context governing the whole run; Ctrl-C or SIGTERM stops it like -max-runtime does
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *maxRuntime > 0 { // Global deadline for cron jobs
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxRuntime)
+		defer cancel()
+	}
+
+	retries.limit = *retryBudgetFlag
+
+	if *logLevel != "info" && *logLevel != "debug" { // Reject unknown levels early
+		fatal(fmt.Errorf("invalid -log-level %q (expected info or debug)", *logLevel))
+	}
+	if *outputFormat != "table" && *outputFormat != "csv" && *outputFormat != "json" {
+		fatal(fmt.Errorf("invalid -format %q (expected table, csv or json)", *outputFormat))
+	}
+	if *streamPages { // These all need the whole page in memory
+		for name, set := range map[string]bool{
+			"-http-cache":           *httpCacheDir != "",
+			"-soft-404-marker":      len(*soft404Markers) > 0,
+			"-category":             len(*categories) > 0,
+			"-normalize-whitespace": *normalizeWhitespace,
+			"-download-images":      *downloadImages,
+			"-list-products":        *listProducts,
+		} {
+			if set {
+				fatal(fmt.Errorf("-stream-pages cannot be combined with %s", name))
+			}
+		}
+	}
+	if *archivePath != "" {
+		if archiveFormat(*archivePath) == "" {
+			fatal(fmt.Errorf("invalid -archive %q (expected a .tar.gz, .tgz or .zip file)", *archivePath))
+		}
+		for name, set := range map[string]bool{ // These all work on the saved files
+			"-compress":               *compressPDFs,
+			"-extract-zips":           *extractZips,
+			"-validate-pdf-structure": *validatePDFStructure,
+			"-expected-hashes":        *expectedHashesFile != "",
+			"-only-missing":           *onlyMissing,         // Would find nothing on disk and fetch everything again
+			"-skip-newer-than":        *skipNewerThan != "", // Likewise
+		} {
+			if set {
+				fatal(fmt.Errorf("-archive cannot be combined with %s", name))
+			}
+		}
+	}
+	if *pollInterval > 0 && (*listProducts || *dumpLinks != "") { // These stop before downloading
+		fatal(errors.New("-poll cannot be combined with -list-products or -dump-links"))
+	}
+	if *onCollision != "skip" && *onCollision != "overwrite" && *onCollision != "suffix" {
+		fatal(fmt.Errorf("invalid -on-collision %q (expected skip, overwrite or suffix)", *onCollision))
+	}
+
+	if *baseURLFlag != "" { // Point the run at a staging or internal mirror of the site
+		base, err := parseBaseURL(*baseURLFlag)
+		if err != nil {
+			fatal(err)
+		}
+		baseURL = base
+		log.Printf("Using base URL %s", baseURL)
+	}
+
+	network, err := dialNetwork(*ipVersion) // Work around broken IPv6 (or IPv4) routes
+	if err != nil {
+		fatal(err)
+	}
+	if transport := sharedTransport(httpClient); transport != nil && network != "tcp" {
+		restrictAddressFamily(transport, network)
+	}
+
+	minimumTLS, found := tlsVersions[*minTLS] // Compliance floor for every HTTPS connection
+	if !found {
+		fatal(fmt.Errorf("invalid -min-tls %q (expected 1.0, 1.1, 1.2 or 1.3)", *minTLS))
+	}
+	if transport := sharedTransport(httpClient); transport != nil {
+		requireTLSVersion(transport, minimumTLS)
+	}
+
+	if *proxyFlag != "" { // Egress only through a proxy; replaces the -ip-version dialer for SOCKS
+		if transport := sharedTransport(httpClient); transport != nil {
+			if err := configureProxy(transport, *proxyFlag); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	if err := seedCookieJar(httpClient, *seedCookies); err != nil { // Pre-set cookies such as a terms-accepted gate
+		fatal(err)
+	}
+
+	mode, found := filenameModes[*filenameMode]
+	if !found {
+		fatal(fmt.Errorf("invalid -filename-mode %q (expected strict or relaxed)", *filenameMode))
+	}
+	sanitizer, found := sanitizers[*sanitizerName]
+	if !found {
+		fatal(fmt.Errorf("invalid -sanitizer %q (expected default or sharepoint)", *sanitizerName))
+	}
+	downloader := &Downloader{Client: httpClient, Sanitizer: sanitizer(mode)}
+
+	if *nameTemplate != "" { // Custom filenames
+		parsed, err := parseNameTemplate(*nameTemplate)
+		if err != nil {
+			fatal(fmt.Errorf("invalid -name-template: %w", err))
+		}
+		filenameTemplate = parsed
+	}
+
+	var skipNewerThanAge time.Duration                        // Parsed -skip-newer-than window; 0 when unset
+	workerCount, autoConcurrency := 1, *concurrency == "auto" // Download workers, and whether their number adapts
+	if autoConcurrency {
+		if *maxConcurrency < 1 {
+			fatal(fmt.Errorf("invalid -max-concurrency %d (expected at least 1)", *maxConcurrency))
+		}
+		workerCount = *maxConcurrency
+	} else {
+		count, err := strconv.Atoi(*concurrency)
+		if err != nil {
+			fatal(fmt.Errorf("invalid -concurrency %q (expected a number or auto)", *concurrency))
+		}
+		workerCount = max(count, 1)
+	}
+
+	var shuffler *rand.Rand // Randomizes the scrape and download order with -shuffle
+	if *shuffle {
+		seed := *shuffleSeed
+		if seed == 0 { // A new order every run; logged so it can be repeated
+			seed = time.Now().UnixNano()
+		}
+		shuffler = rand.New(rand.NewPCG(uint64(seed), 0))
+		log.Printf("Shuffling the processing order with -seed %d", seed)
+	}
+
+	if *skipNewerThan != "" {
+		age, err := parseAge(*skipNewerThan)
+		if err != nil {
+			fatal(fmt.Errorf("invalid -skip-newer-than: %w", err))
+		}
+		skipNewerThanAge = age
+	}
+
+	if *maxTotalBytes != "" { // Budget for metered connections and small disks
+		limit, err := parseByteSize(*maxTotalBytes)
+		if err != nil {
+			fatal(fmt.Errorf("invalid -max-total-bytes: %w", err))
+		}
+		byteCap = limit
+	}
+
+	if *maxBandwidth != "" { // Share one byte budget across all download workers
+		rate, err := parseByteSize(*maxBandwidth)
+		if err != nil {
+			fatal(fmt.Errorf("invalid -max-bandwidth: %w", err))
+		}
+		bandwidth = &bandwidthLimiter{rate: float64(rate), last: time.Now()}
+	}
+
+	languageMarkers, err := parseLanguageMap(*languageMap) // Filename words that mark a document's language
+	if err != nil {
+		fatal(fmt.Errorf("invalid -language-map: %w", err))
+	}
+	for index, language := range *languageFilter {
+		(*languageFilter)[index] = strings.ToLower(language)
+	}
+
+	// Approved digests by filename, from -expected-hashes
+	var expectedHashes map[string]string
+	if *expectedHashesFile != "" {
+		expectedHashes, err = loadExpectedHashes(*expectedHashesFile, *strictHashes)
+		if err != nil {
+			fatal(err)
+		}
+		log.Printf("Loaded %d expected hash(es) from %s", len(expectedHashes), *expectedHashesFile)
+	} else if *strictHashes {
+		fatal(errors.New("-strict requires -expected-hashes"))
+	}
+
+	if *userAgentsFile != "" { // Load the User-Agent rotation pool
+		agents, err := loadUserAgents(*userAgentsFile)
+		if err != nil {
+			fatal(err)
+		}
+		userAgents = agents
+		log.Printf("Rotating through %d User-Agent(s)", len(userAgents))
+	}
+
+	if *exportURLs != "" { // Write the built-in product page list for editing and use with -urls
+		pages := removeDuplicatesFromSlice(productPageURLs)
+		sort.Strings(pages)
+		if err := writeLines(*exportURLs, pages); err != nil {
+			fatal(err)
+		}
+		log.Printf("Wrote %d product page URL(s) to %s", len(pages), *exportURLs)
+		return
+	}
+
+	if *oneURL != "" { // Stream a single document for shell pipelines; nothing is written to disk
+		written, err := downloader.streamPDF(ctx, rebaseURL(*oneURL), os.Stdout)
+		if err != nil {
+			log.Printf("%s: %v", *oneURL, err)
+			os.Exit(exitFailures)
+		}
+		log.Printf("Wrote %s from %s to stdout", formatBytes(written), *oneURL)
+		return
+	}
+
+	if *resolveOnly != "" { // Plan the archive layout offline
+		lines, err := readListFile(*resolveOnly)
+		if err != nil {
+			fatal(fmt.Errorf("-resolve-only: %w", err))
+		}
+		var urls []string
+		for _, line := range lines {
+			if !isUrlValid(line) {
+				log.Printf("Ignoring invalid URL in %s: %s", *resolveOnly, line)
+				continue
+			}
+			urls = append(urls, line)
+		}
+		if filenameTemplate != nil { // Template fields come from the response
+			log.Println("-name-template needs each response; showing the names used when it can't be resolved")
+		}
+		urls = removeDuplicatesFromSlice(urls)
+		collisions, err := downloader.printFilenameMapping(urls)
+		if err != nil {
+			fatal(err)
+		}
+		log.Printf("%d URL(s), %d filename collision(s) with -filename-mode %s and -sanitizer %s", len(urls), collisions, *filenameMode, *sanitizerName)
+		return
+	}
+
 	outputDir := "PDFs/" // Directory to store downloaded PDFs
 
-	if !directoryExists(outputDir) { // Check if directory exists
-		createDirectory(outputDir, 0o755) // Create directory with read-write-execute permissions
-	}
-
-	// The location to the local.
-	localFile := "nclonline.html"
-	// Check if the local file exists.
-	if fileExists(localFile) {
-		removeFile(localFile)
-	}
-	// The location to the remote url.
-	remoteURL := []string{
-		"https://www.nclonline.com/products/sds_alpha",
-		"https://www.nclonline.com/products/view/15_COCONUT_OIL",
-		"https://www.nclonline.com/products/view/24_7_",
-		"https://www.nclonline.com/products/view/Afia_ALCOHOL_BASED",
-		"https://www.nclonline.com/products/view/Afia_Alcohol_Free",
-		"https://www.nclonline.com/products/view/Afia_Anti_Bacterial",
-		"https://www.nclonline.com/products/view/Afia_Earth_Sense_Certified_Green_Foaming",
-		"https://www.nclonline.com/products/view/Afia_Foaming_E2",
-		"https://www.nclonline.com/products/view/Afia_Foaming_Hair_and_Body_Wash",
-		"https://www.nclonline.com/products/view/Afia_Harvest_Melon",
-		"https://www.nclonline.com/products/view/Afia_Hypoallergenic_Certified",
-		"https://www.nclonline.com/products/view/Afia_Ocean_Mist",
-		"https://www.nclonline.com/products/view/Afia_Spring_Blossom",
-		"https://www.nclonline.com/products/view/ALL_IN_ONE_",
-		"https://www.nclonline.com/products/view/ALL_OFF_",
-		"https://www.nclonline.com/products/view/ASAP",
-		"https://www.nclonline.com/products/view/ASTRO_CHEM_",
-		"https://www.nclonline.com/products/view/AUTO_KLEEN_",
-		"https://www.nclonline.com/products/view/AVISTAT_D_",
-		"https://www.nclonline.com/products/view/BALANCE_",
-		"https://www.nclonline.com/products/view/BARE_BONES_",
-		"https://www.nclonline.com/products/view/BARE_BONES_LOW_ODOR",
-		"https://www.nclonline.com/products/view/BATHROOM_PLUS_",
-		"https://www.nclonline.com/products/view/BIG_PUNCH",
-		"https://www.nclonline.com/products/view/BLUE_VELVET_",
-		"https://www.nclonline.com/products/view/BOLT_",
-		"https://www.nclonline.com/products/view/BRITE_EYES_",
-		"https://www.nclonline.com/products/view/BULLSEYE_",
-		"https://www.nclonline.com/products/view/BURST_PLUS_",
-		"https://www.nclonline.com/products/view/C_ALL_",
-		"https://www.nclonline.com/products/view/CHEM_EEZ_",
-		"https://www.nclonline.com/products/view/CITRI_SCRUB_",
-		"https://www.nclonline.com/products/view/CITROL",
-		"https://www.nclonline.com/products/view/CITRUS_FLOWER_QUAT",
-		"https://www.nclonline.com/products/view/CITRUS_KLEEN",
-		"https://www.nclonline.com/products/view/CleanSMART_Foaming_Degreaser_Cleaner_SC",
-		"https://www.nclonline.com/products/view/CleanSMART_Pot_Pan_Detergent_SC",
-		"https://www.nclonline.com/products/view/CleanSMART_Sanitizer_1_512",
-		"https://www.nclonline.com/products/view/COMBAT_",
-		"https://www.nclonline.com/products/view/COMMAND_",
-		"https://www.nclonline.com/products/view/CONKLEEN_204_",
-		"https://www.nclonline.com/products/view/CORRAL_",
-		"https://www.nclonline.com/products/view/CREAM_COAT_",
-		"https://www.nclonline.com/products/view/CYCLONE_",
-		"https://www.nclonline.com/products/view/DECADE_",
-		"https://www.nclonline.com/products/view/DEO_PINE_",
-		"https://www.nclonline.com/products/view/DESCUM",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_1",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_10",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_11",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_17",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_19",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_2",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_20",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_21",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_22",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_23",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_24",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_25",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_26",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_3",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_4",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_5",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_6",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_7",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_8",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_9",
-		"https://www.nclonline.com/products/view/DURA_GLOSS_",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_ASPIRE_",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_Certified_Foaming_Hand_Cleaner",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_Certified_Liquid_Hand_Cleaner",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_Degreaser_Cleaner",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_EVERGREEN_FINISH",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_Extra_Heavy_Duty_RTU",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_Foam_Safe",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_GREEN_IMPACT_",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_HD_WASHROOM_CLEANER",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_Multi_Purpose_Neutral_Cleaner",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_Multi_Surface_Concentrate_with_H2O2",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_NEUTRAL_FLOOR_CLEANER",
-		"https://www.nclonline.com/products/view/EARTH_SENSE_RTU_GLASS_HARD_SURFACE_CLEANER",
-		"https://www.nclonline.com/products/view/EASY_DAB_",
-		"https://www.nclonline.com/products/view/ECO_SOLV",
-		"https://www.nclonline.com/products/view/EDGE_PLUS_",
-		"https://www.nclonline.com/products/view/ENDURE_",
-		"https://www.nclonline.com/products/view/ENHANCE_",
-		"https://www.nclonline.com/products/view/ENSEEL_",
-		"https://www.nclonline.com/products/view/ES_Neutral_Disinfectant_Detergent",
-		"https://www.nclonline.com/products/view/ETERNITY_",
-		"https://www.nclonline.com/products/view/ETERNITY_Aerosol_",
-		"https://www.nclonline.com/products/view/EXPOSE_",
-		"https://www.nclonline.com/products/view/EXTREME_PLUS_",
-		"https://www.nclonline.com/products/view/FLEXI_CLEAN",
-		"https://www.nclonline.com/products/view/FLEXI_SHEEN_",
-		"https://www.nclonline.com/products/view/FOAM_SAFE_OCEAN_MIST",
-		"https://www.nclonline.com/products/view/FOAM_BREAK_",
-		"https://www.nclonline.com/products/view/FORTRESS",
-		"https://www.nclonline.com/products/view/FRESH_START_",
-		"https://www.nclonline.com/products/view/GLIMMER_",
-		"https://www.nclonline.com/products/view/GOLDEN_POT_PAN",
-		"https://www.nclonline.com/products/view/GREEN_EMERALD",
-		"https://www.nclonline.com/products/view/HOMBRE_",
-		"https://www.nclonline.com/products/view/HURRAH_CAR_WASH",
-		"https://www.nclonline.com/products/view/HURRICANE_",
-		"https://www.nclonline.com/products/view/IMAGE_",
-		"https://www.nclonline.com/products/view/IMPRESSIONS_",
-		"https://www.nclonline.com/products/view/INCREDILOSO_",
-		"https://www.nclonline.com/products/view/INCREDILOSO_Lavender",
-		"https://www.nclonline.com/products/view/INVINCIBLE_",
-		"https://www.nclonline.com/products/view/KITCHEN_MATE",
-		"https://www.nclonline.com/products/view/KLEER_BRITE_",
-		"https://www.nclonline.com/products/view/LAVENDER_QUAT",
-		"https://www.nclonline.com/products/view/LEMON_QUAT",
-		"https://www.nclonline.com/products/view/LUSTER",
-		"https://www.nclonline.com/products/view/LVT_CLEAN",
-		"https://www.nclonline.com/products/view/LVT_PROTECT",
-		"https://www.nclonline.com/products/view/MAGIC_BREEZE_Herbal",
-		"https://www.nclonline.com/products/view/MAGIC_BREEZE_Lavender",
-		"https://www.nclonline.com/products/view/MAIN_SQUEEZE_CLEANER",
-		"https://www.nclonline.com/products/view/MAIN_SQUEEZE_DEGREASER",
-		"https://www.nclonline.com/products/view/MAIN_SQUEEZE_GLASS",
-		"https://www.nclonline.com/products/view/MAIN_SQUEEZE_Lavender_256",
-		"https://www.nclonline.com/products/view/MARVEL",
-		"https://www.nclonline.com/products/view/MATTE",
-		"https://www.nclonline.com/products/view/MICRO_CHEM_PLUS_",
-		"https://www.nclonline.com/products/view/MINT_QUAT",
-		"https://www.nclonline.com/products/view/MIRAGE",
-		"https://www.nclonline.com/products/view/MOLD_AWAY_",
-		"https://www.nclonline.com/products/view/MRP_",
-		"https://www.nclonline.com/products/view/MULTI_STAT_",
-		"https://www.nclonline.com/products/view/NATURAL_MIRACLE_",
-		"https://www.nclonline.com/products/view/NATURE_S_FORCE",
-		"https://www.nclonline.com/products/view/NATURE_S_POWER",
-		"https://www.nclonline.com/products/view/NATURE_S_SOLUTION_",
-		"https://www.nclonline.com/products/view/NCL_2_",
-		"https://www.nclonline.com/products/view/NCLwipes_Lemon_Fresh",
-		"https://www.nclonline.com/products/view/NCLwipes_Waterfall_Fresh",
-		"https://www.nclonline.com/products/view/NEUTRA_CIDE_256",
-		"https://www.nclonline.com/products/view/NEUTRAL_Q_",
-		"https://www.nclonline.com/products/view/NEXT_CENTURY_",
-		"https://www.nclonline.com/products/view/NEXT_STEP_",
-		"https://www.nclonline.com/products/view/NO_ZAP_STATIC_DISSIPATIVE_FLOOR_COATING",
-		"https://www.nclonline.com/products/view/NU_HIDE_",
-		"https://www.nclonline.com/products/view/NU_LOOK",
-		"https://www.nclonline.com/products/view/ONE_COAT_25_",
-		"https://www.nclonline.com/products/view/ONE_STEP_",
-		"https://www.nclonline.com/products/view/ONE_",
-		"https://www.nclonline.com/products/view/PATINA_",
-		"https://www.nclonline.com/products/view/PERFECTION_",
-		"https://www.nclonline.com/products/view/pH_ENOMENAL_",
-		"https://www.nclonline.com/products/view/PICTURE_PERFECT_",
-		"https://www.nclonline.com/products/view/PINE_QUAT_PLUS_",
-		"https://www.nclonline.com/products/view/PINK_LOTION",
-		"https://www.nclonline.com/products/view/PINK_N_CREAMY",
-		"https://www.nclonline.com/products/view/PINK_SUDS",
-		"https://www.nclonline.com/products/view/PIZZAZZ_",
-		"https://www.nclonline.com/products/view/POOFF_",
-		"https://www.nclonline.com/products/view/POP_SHINE_",
-		"https://www.nclonline.com/products/view/POP_SHINE_RTU",
-		"https://www.nclonline.com/products/view/PRO_SEEL_",
-		"https://www.nclonline.com/products/view/ProLEX_CDL_520",
-		"https://www.nclonline.com/products/view/ProLEX_HTR_260",
-		"https://www.nclonline.com/products/view/ProLEX_LTD_220",
-		"https://www.nclonline.com/products/view/ProLEX_LTR_250",
-		"https://www.nclonline.com/products/view/QWIK_SCRUB_",
-		"https://www.nclonline.com/products/view/RELY",
-		"https://www.nclonline.com/products/view/RINSE_AWAY_PLUS_",
-		"https://www.nclonline.com/products/view/ROAD_AWAY",
-		"https://www.nclonline.com/products/view/ROCK_HARD_",
-		"https://www.nclonline.com/products/view/RUFF_N_READY",
-		"https://www.nclonline.com/products/view/SANIQUAT",
-		"https://www.nclonline.com/products/view/SEA_BRITE_",
-		"https://www.nclonline.com/products/view/SHA_ZYME_",
-		"https://www.nclonline.com/products/view/SHA_ZYME_DRC",
-		"https://www.nclonline.com/products/view/SHA_ZYME_RTU",
-		"https://www.nclonline.com/products/view/SHIELD",
-		"https://www.nclonline.com/products/view/SOFT_N_CREAMY",
-		"https://www.nclonline.com/products/view/SPIT_SHINE_",
-		"https://www.nclonline.com/products/view/SPRAY_KLEEN_PLUS_",
-		"https://www.nclonline.com/products/view/SPRITZ_",
-		"https://www.nclonline.com/products/view/STAMINA_",
-		"https://www.nclonline.com/products/view/STONE_BEAUTY_",
-		"https://www.nclonline.com/products/view/STONE_KLEEN_",
-		"https://www.nclonline.com/products/view/SUN_SPRAY",
-		"https://www.nclonline.com/products/view/SUPER_CHERRY",
-		"https://www.nclonline.com/products/view/SUPER_NAC_",
-		"https://www.nclonline.com/products/view/SUPER_PURGE",
-		"https://www.nclonline.com/products/view/SUPER_SONIC_",
-		"https://www.nclonline.com/products/view/SURFACE_BARRIER_",
-		"https://www.nclonline.com/products/view/SURFACE_PREP_",
-		"https://www.nclonline.com/products/view/SURGE_",
-		"https://www.nclonline.com/products/view/TANNIN_OUT_",
-		"https://www.nclonline.com/products/view/TOTAL_",
-		"https://www.nclonline.com/products/view/TRIGGER_",
-		"https://www.nclonline.com/products/view/TWISTER_",
-		"https://www.nclonline.com/products/view/ULTRAMAX_",
-		"https://www.nclonline.com/products/view/UPPER_HAND_",
-		"https://www.nclonline.com/products/view/VIGOR_",
-		"https://www.nclonline.com/products/view/VISIONS_",
-		"https://www.nclonline.com/products/view/VIVID_",
-		"https://www.nclonline.com/products/view/WASH_BRITE_",
-		"https://www.nclonline.com/products/view/WHITE_PEARL",
-		"https://www.nclonline.com/products/view/WITHSTAND_",
-		"https://www.nclonline.com/products/view/WORLD_CLASS_",
-		"https://www.nclonline.com/products/view/WRANGLER_",
-		"https://www.nclonline.com/products/view/ZooooM_",
-		"https://www.nclonline.com/products/flyer_alpha.php",
-		"https://www.nclonline.com/products/view/Afia_Drip_Tray",
-		"https://www.nclonline.com/products/view/Afia_Floor_Dispenser_Stand_White",
-		"https://www.nclonline.com/products/view/Afia_Manual_Dispenser",
-		"https://www.nclonline.com/products/view/Afia_Touch_Free",
-		"https://www.nclonline.com/products/view/CleanSMART_Foam_Dispensing_Unit",
-		"https://www.nclonline.com/products/view/CleanSMART_Sink_Dispensing_Unit",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_Jr_",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_PORTABLE",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_PORTABLE_KIT",
-		"https://www.nclonline.com/products/view/DUAL_BLEND_WALL",
-		"https://www.nclonline.com/products/view/ECONO_DIAMONDS",
-		"https://www.nclonline.com/products/view/FOAM_MAGIC",
-		"https://www.nclonline.com/products/view/GRANITE_MASTER_",
-		"https://www.nclonline.com/products/view/HANDI_RACK_Round_Gallon_",
-		"https://www.nclonline.com/products/view/INDUSTRIAL_HAND_SOAP_DISPENSER",
-		"https://www.nclonline.com/products/view/LUMINAIRE_",
-		"https://www.nclonline.com/products/view/MECHANICS_SELECT_HAND_CARE_PUMP",
-		"https://www.nclonline.com/products/view/NAT_SPEED_",
-		"https://www.nclonline.com/products/view/NAT_SPLASH_GUARD",
-		"https://www.nclonline.com/products/view/NAT_STONE_Pad_Driver",
-		"https://www.nclonline.com/products/view/Pak_SMART_Cap",
-		"https://www.nclonline.com/products/view/PRO_SERIES_STONE_BLAZER_",
-		"https://www.nclonline.com/products/view/Refillable_Foaming_Hand_Cleaner_Dispener_Cartridge",
-		"https://www.nclonline.com/products/view/RSC_Foaming_Nozzle",
-		"https://www.nclonline.com/products/view/STONE_BLAZER_",
-		"https://www.nclonline.com/products/view/UNI_POWER_",
-		"https://www.nclonline.com/products/view/WET_CONCRETE_DIAMONDS",
-	}
-	// Loop over the urls and save content to file.
-	for _, url := range remoteURL {
-		// Call fetchPage to download the content of that page
-		pageContent := getDataFromURL(url)
-		// Append it and save it to the file.
-		appendAndWriteToFile(localFile, pageContent)
-	}
-	// Read the file content
-	fileContent := readAFileAsString(localFile)
-	// Extract the URLs from the given content.
-	extractedPDFURLs := extractPDFUrls(fileContent)
-	// Remove duplicates from the slice.
-	extractedPDFURLs = removeDuplicatesFromSlice(extractedPDFURLs)
-	// Loop through all extracted PDF URLs
-	for _, urls := range extractedPDFURLs {
-		if !hasDomain(urls) {
-			urls = "https://www.nclonline.com" + urls
-
-		}
-		if isUrlValid(urls) { // Check if the final URL is valid
-			downloadPDF(urls, outputDir) // Download the PDF
+	for _, setting := range []struct {
+		name  string
+		value string
+		mode  *os.FileMode
+	}{{"-file-mode", *fileModeFlag, &fileMode}, {"-dir-mode", *dirModeFlag, &dirMode}} {
+		mode, err := parsePermissions(setting.value)
+		if err != nil {
+			fatal(fmt.Errorf("invalid %s: %w", setting.name, err))
+		}
+		*setting.mode = mode
+	}
+	if err := prepareOutputDirectory(outputDir); err != nil { // Create it, or say why it can't be used
+		fatal(err)
+	}
+
+	if *compareDir != "" { // Report differences against a previous download set instead of downloading
+		hashWorkers := 1
+		if *parallelHash { // Hashing is CPU-bound; reuse -concurrency to use several cores
+			hashWorkers = workerCount
+		}
+		diff, err := compareDirectories(outputDir, *compareDir, hashWorkers)
+		if err != nil {
+			fatal(err)
+		}
+		printDirectoryDiff(diff, *compareJSON)
+		return
+	}
+	if err := checkWritable(outputDir); err != nil { // Everything below writes to it
+		fatal(err)
+	}
+
+	if *forceDownload && !confirmAction(fmt.Sprintf("-force will download every PDF again, overwriting the copies in %s. Continue?", outputDir)) {
+		fatal(errors.New("-force was not confirmed"))
+	}
+
+	// Keep overlapping runs (e.g. cron and a manual run) from clobbering each other's output
+	if err := acquireLock(ctx, filepath.Join(outputDir, lockFilename), *waitForLock); err != nil {
+		fatal(err)
+	}
+	defer finishRun()
+
+	if *minFreeSpace > 0 { // Fail fast rather than leave truncated files when the disk fills mid-run
+		available, err := availableSpace(outputDir)
+		if err != nil {
+			log.Printf("Skipping free space check: %v", err)
+		} else if available < uint64(*minFreeSpace) {
+			fatal(fmt.Errorf("only %s free in %s; -min-free-space requires %s", formatBytes(int64(available)), outputDir, formatBytes(*minFreeSpace)))
+		}
+	}
+
+	// Clear what a crashed run left behind before the existence checks trust the directory
+	cleanupLeftovers(outputDir, *partMaxAge)
+
+	// One pass of the pipeline: scrape the product pages, download, report. Returns
+	// the exit code, and the error when the cycle could not run at all (e.g. a failed
+	// -health-check); -poll runs it again every interval.
+	runCycle := func(ctx context.Context) (int, error) {
+		if *archivePath != "" { // Collect this run's downloads into a single file
+			archive, err := openArchive(*archivePath)
+			if err != nil {
+				return exitFatal, err
+			}
+			documentArchive = archive
+			defer finishArchive() // Complete after every cycle, so -poll leaves a usable archive between them
+			log.Printf("Writing downloads to %s (%d document(s) already in it)", *archivePath, len(archive.previous))
+		}
+
+		// The location to the local.
+		localFile := "nclonline.html"
+		// Check if the local file exists.
+		if fileExists(localFile) {
+			removeFile(localFile)
+		}
+		// The location to the remote url.
+		remoteURL := productPageURLs
+		// PDF URLs given directly in the -urls file, e.g. a pending.txt from an earlier run
+		var directPDFURLs []string
+		// List file each page or PDF URL came from (rebased), recorded in the manifest
+		listSources := make(map[string]string)
+		if len(*urlsFiles) > 0 {
+			remoteURL = nil
+			for _, listFile := range *urlsFiles { // One list per product family, merged into one run
+				pages, pdfs, err := loadURLList(listFile)
+				if err != nil { // Its documents would otherwise look orphaned to -prune
+					return exitFatal, err
+				}
+				log.Printf("Loaded %d product page(s) and %d PDF URL(s) from %s", len(pages), len(pdfs), listFile)
+				for _, uri := range slices.Concat(pages, pdfs) {
+					if _, seen := listSources[rebaseURL(uri)]; !seen { // The first list naming a URL owns it
+						listSources[rebaseURL(uri)] = listFile
+					}
+				}
+				remoteURL = append(remoteURL, pages...)
+				directPDFURLs = append(directPDFURLs, pdfs...)
+			}
+		}
+		if *slugsFile != "" { // Short product names instead of full URLs
+			slugs, err := readListFile(*slugsFile)
+			if err != nil {
+				return exitFatal, fmt.Errorf("-slugs: %w", err)
+			}
+			slugPages := expandSlugs(slugs, *productPath)
+			log.Printf("Loaded %d product page(s) from slugs in %s", len(slugPages), *slugsFile)
+			for _, uri := range slugPages {
+				if _, seen := listSources[rebaseURL(uri)]; !seen {
+					listSources[rebaseURL(uri)] = *slugsFile
+				}
+			}
+			if len(*urlsFiles) == 0 {
+				remoteURL = nil // Replace the built-in list, as -urls does
+			}
+			remoteURL = append(slices.Clone(remoteURL), slugPages...)
+		}
+		// Spellings that normalized to the same URL, for -dedupe-report
+		pageSpellings := newDedupeTracker()
+		pdfSpellings := newDedupeTracker()
+		for _, pageURL := range remoteURL {
+			pageSpellings.add(normalizePageURL(pageURL), pageURL)
+		}
+		if unique := removeDuplicatesFromSlice(remoteURL); len(unique) < len(remoteURL) { // Avoid scraping the same page twice
+			log.Printf("Collapsed %d duplicate product page URL(s)", len(remoteURL)-len(unique))
+			remoteURL = unique
+		}
+		// Sorted for a deterministic order, which -seed then shuffles reproducibly
+		remoteURL = slices.Sorted(slices.Values(remoteURL))
+		if shuffler != nil { // Visit the site's sections in a different order each run
+			shuffler.Shuffle(len(remoteURL), func(i, j int) { remoteURL[i], remoteURL[j] = remoteURL[j], remoteURL[i] })
+		}
+		if *healthCheck { // Catch a down or changed site before hundreds of requests fail
+			preflight := splitList(*healthCheckURLs)
+			if len(preflight) == 0 {
+				preflight = []string{baseURL + "/"}
+				if len(remoteURL) > 0 {
+					preflight = append(preflight, rebaseURL(remoteURL[0]))
+				}
+			}
+			for _, uri := range preflight {
+				started := time.Now()
+				result, err := downloader.checkPage(ctx, uri)
+				if err != nil {
+					return exitFatal, fmt.Errorf("preflight FAILED for %s: %w", uri, err)
+				}
+				log.Printf("Preflight OK: %s (%s in %s)", uri, result, time.Since(started).Round(time.Millisecond))
+			}
+		}
+		// Query parameters removed from extracted links
+		trackingParams := splitList(*stripParams)
+		// PDF URLs in discovery order, and the product pages referencing each one
+		discovered := newURLSet()
+		// Metadata for each scraped product page
+		products := make(map[string]productMetadata)
+		// Product pages that passed the -category filter
+		matchedProducts := 0
+		// Product pages that returned a "not found" body with 200 OK
+		var deadPages []string
+		// Time spent per phase, for -timings
+		var timings phaseTimings
+		// Product pages not scraped because the deadline was reached
+		var unscrapedPages []string
+		// Whether every product page was scraped and kept, which -prune relies on
+		var coverage scrapeCoverage
+		// Images found on the product pages, for -download-images
+		var images []productImage
+		// Records the PDF links found on a product page; relative links resolve against contentURL
+		addPageLinks := func(pageURL string, contentURL string, links []string) {
+			for _, link := range links {
+				resolved := resolvePDFURL(contentURL, link)          // Resolve relative links
+				link = stripTrackingParams(resolved, trackingParams) // Drop tracking parameters before dedupe and naming
+				if !isUrlValid(link) {                               // Keep only valid URLs
+					continue
+				}
+				pdfSpellings.add(link, resolved)
+				discovered.add(link, pageURL)
+			}
+		}
+		// Loop over the urls, save content to file and extract each page's PDF links.
+		for pageIndex, pageURL := range remoteURL {
+			if ctx.Err() != nil { // Out of time; download what was found so far
+				log.Printf("Stopping scrape early: %v", ctx.Err())
+				unscrapedPages = remoteURL[pageIndex:]
+				break
+			}
+			if *maxPages > 0 && pageIndex >= *maxPages { // Safety cap on the number of pages fetched
+				log.Printf("WARNING: reached -max-pages %d; skipping the remaining %d product page(s)", *maxPages, len(remoteURL)-pageIndex)
+				coverage.Capped = true
+				break
+			}
+			pageURL = rebaseURL(pageURL) // Scrape the -base-url site instead of the live one
+			fetchStarted := time.Now()
+			if *streamPages { // Parse the page as it downloads instead of holding it in memory
+				streamCtx, cancelStream := context.WithTimeout(ctx, *extractTimeout) // Bounds the fetch too, since the two overlap
+				pageLinks, err := downloader.streamPDFUrls(streamCtx, pageURL, localFile)
+				cancelStream()
+				timings.Scrape += time.Since(fetchStarted) // Fetching and extracting are one phase here
+				timings.Pages++
+				if err != nil {
+					logf(ctx, "Failed to scrape %s: %v", pageURL, err)
+					coverage.FailedPages = append(coverage.FailedPages, pageURL)
+				}
+				addPageLinks(pageURL, pageURL, pageLinks) // Links read before a failure are still real
+				continue
+			}
+			// Call fetchPage to download the content of that page
+			pageContent, err := downloader.getDataFromURL(ctx, pageURL)
+			// Page the content finally came from, after any meta refresh; relative links resolve against it
+			contentURL := pageURL
+			if err == nil {
+				contentURL, pageContent, err = downloader.followMetaRefresh(ctx, pageURL, pageContent)
+			}
+			if err != nil { // Its links are unknown, so its documents must not look orphaned
+				logf(ctx, "Failed to scrape %s: %v", pageURL, err)
+				coverage.FailedPages = append(coverage.FailedPages, pageURL)
+				timings.Scrape += time.Since(fetchStarted)
+				timings.Pages++
+				continue
+			}
+			// Append it and save it to the file.
+			if *htmlMarkers { // Delimit the page so it can be found and re-extracted offline
+				appendAndWriteToFile(localFile, pageMarker("BEGIN", contentURL)+"\n"+pageContent+"\n"+pageMarker("END", contentURL))
+			} else {
+				appendAndWriteToFile(localFile, pageContent)
+			}
+			timings.Scrape += time.Since(fetchStarted)
+			timings.Pages++
+			if marker := soft404Marker(pageContent, *soft404Markers); marker != "" { // 200 OK, but the product is gone
+				log.Printf("Likely dead product page (soft 404, matched %q): %s", marker, pageURL)
+				deadPages = append(deadPages, pageURL)
+				continue
+			}
+			extractStarted := time.Now()
+			// Record what the page is about
+			metadata := extractProductMetadata(pageContent)
+			products[pageURL] = metadata
+			if len(*categories) > 0 { // Only keep pages in the requested categories
+				if !matchesCategory(metadata.Category, *categories) {
+					timings.Extract += time.Since(extractStarted)
+					continue
+				}
+				matchedProducts++
+			}
+			// Extract the URLs from the page content.
+			extractCtx, cancelExtract := context.WithTimeout(ctx, *extractTimeout) // Bound the parse of the scraped HTML
+			if *normalizeWhitespace {                                              // Repair attribute values broken across lines
+				pageContent = normalizeHTML(pageContent)
+			}
+			pageLinks := extractPDFUrls(extractCtx, pageContent)
+			cancelExtract()
+			addPageLinks(pageURL, contentURL, pageLinks)
+			if *downloadImages { // Product photos for the catalog
+				for _, src := range extractImageURLs(pageContent) {
+					if imageURL := resolvePDFURL(contentURL, src); isUrlValid(imageURL) {
+						images = append(images, productImage{URL: imageURL, Product: pageURL})
+					}
+				}
+			}
+			timings.Extract += time.Since(extractStarted)
+		}
+		dedupeStarted := time.Now()
+		if len(*categories) > 0 {
+			log.Printf("%d of %d product page(s) matched -category %s", matchedProducts, len(products), categories)
+		}
+		coverage.Filtered = len(*categories) > 0 || len(*languageFilter) > 0 || len(*excludePatterns) > 0 || *excludeFile != ""
+		for _, link := range directPDFURLs { // Listed PDFs need no scraping
+			rebased := rebaseURL(link)
+			stripped := stripTrackingParams(rebased, trackingParams) // Same normalization as scraped links
+			if _, listed := listSources[stripped]; !listed {
+				listSources[stripped] = listSources[rebased]
+			}
+			pdfSpellings.add(stripped, rebased)
+			discovered.add(stripped, "")
+		}
+		// Every distinct URL, deduplicated as it was discovered
+		downloadURLs := discovered.list()
+		// Drop denylisted documents
+		exclusions := append([]string(nil), *excludePatterns...)
+		if *excludeFile != "" {
+			patterns, err := readListFile(*excludeFile)
+			if err != nil {
+				return exitFatal, fmt.Errorf("-exclude-file: %w", err)
+			}
+			exclusions = append(exclusions, patterns...)
+		}
+		if len(exclusions) > 0 {
+			var kept []string
+			for _, uri := range downloadURLs {
+				if downloader.isExcluded(uri, exclusions) {
+					debugf(ctx, "Excluded %s", uri)
+					continue
+				}
+				kept = append(kept, uri)
+			}
+			log.Printf("Excluded %d of %d PDF URL(s)", len(downloadURLs)-len(kept), len(downloadURLs))
+			downloadURLs = kept
+		}
+		if len(*languageFilter) > 0 { // Keep the requested languages and documents that name none
+			counts := make(map[string]int)
+			var kept []string
+			for _, uri := range downloadURLs {
+				language := documentLanguage(uri, languageMarkers)
+				if language == "" {
+					language = "unmarked"
+				}
+				counts[language]++
+				if language == "unmarked" || slices.Contains(*languageFilter, language) {
+					kept = append(kept, uri)
+				}
+			}
+			var breakdown []string
+			for _, language := range slices.Sorted(maps.Keys(counts)) {
+				breakdown = append(breakdown, fmt.Sprintf("%s %d", language, counts[language]))
+			}
+			log.Printf("PDF URLs by language: %s; keeping %d for -language %s", strings.Join(breakdown, ", "), len(kept), languageFilter)
+			downloadURLs = kept
+		}
+		timings.Extract += time.Since(dedupeStarted)
+		timings.URLs = len(downloadURLs)
+		// Show what the URL normalization merged
+		if *dedupeReport != "" {
+			writeDedupeReport(*dedupeReport, append(pageSpellings.groups("product_page"), pdfSpellings.groups("pdf")...))
+		}
+		// Report which product pages share each document
+		if *writeReferences {
+			writeReferencesFile(filepath.Join(outputDir, referencesFilename), discovered.references())
+		}
+		// Print the product overview and stop before downloading
+		if *listProducts {
+			if err := printCatalog(buildCatalog(products, discovered.references()), *outputFormat); err != nil {
+				return exitFatal, err
+			}
+			return 0, nil
+		}
+		// Write the URL list and stop before downloading
+		if *dumpLinks != "" {
+			links := append([]string(nil), downloadURLs...)
+			sort.Strings(links) // Deterministic output
+			if err := writeLines(*dumpLinks, links); err != nil {
+				return exitFatal, err
+			}
+			log.Printf("Wrote %d PDF URL(s) to %s", len(links), *dumpLinks)
+			return 0, nil
+		}
+		// Index of downloaded files
+		records := loadManifest(filepath.Join(outputDir, manifestFilename))
+		// Track download progress so an interrupted run can be resumed
+		progress := newCheckpoint(filepath.Join(outputDir, ".checkpoint"), *checkpointInterval, *resumeRun)
+		// URLs to download; the full set is still used for pruning
+		queue := downloadURLs
+		if *latestOnlyFlag { // One revision per product page
+			queue = downloader.latestOnly(ctx, queue, discovered.references())
+			log.Printf("Latest only: kept %d of %d PDF URL(s)", len(queue), len(downloadURLs))
+		}
+		if *onlyMissing { // Skip documents already in the archive without touching the network
+			candidates := len(queue)
+			queue = downloader.missingURLs(queue, outputDir, records)
+			log.Printf("%d missing of %d", len(queue), candidates)
+		}
+		// Outcome counts for the summary, shared by the workers
+		summary := runSummary{Version: versionString(), DeadPages: len(deadPages)}
+		if *dedupeAcrossRuns && !redownloadExisting() { // Trust the manifest instead of asking the server again
+			known := records.urls()
+			var fresh []string
+			for _, uri := range queue {
+				if !known[uri] {
+					fresh = append(fresh, uri)
+				}
+			}
+			summary.Skipped += len(queue) - len(fresh)
+			log.Printf("Skipping %d URL(s) downloaded by earlier runs", len(queue)-len(fresh))
+			queue = fresh
+		}
+		if skipNewerThanAge > 0 { // Recently refreshed files need no request at all, even with -force
+			recent := downloader.withoutRecent(queue, outputDir, records, skipNewerThanAge)
+			summary.Skipped += len(queue) - len(recent)
+			log.Printf("Skipping %d URL(s) saved within the last %s", len(queue)-len(recent), *skipNewerThan)
+			queue = recent
+		}
+		// A sorted copy; downloadURLs keeps discovery order for pruning and reports
+		queue = slices.Sorted(slices.Values(queue))
+		if shuffler != nil { // Spread the downloads over the site as well
+			shuffler.Shuffle(len(queue), func(i, j int) { queue[i], queue[j] = queue[j], queue[i] })
+		}
+		var summaryMutex sync.Mutex
+		// Download phase context; -fail-fast cancels it without cancelling the whole run
+		downloadCtx, stopDownloads := context.WithCancelCause(ctx)
+		defer stopDownloads(nil)
+		// Adapts the number of parallel downloads with -concurrency auto
+		var adaptive *concurrencyController
+		if autoConcurrency {
+			adaptive = newConcurrencyController(downloadCtx, workerCount)
+		}
+		// Failed downloads since the last successful one, guarded by summaryMutex
+		consecutiveFailures := 0
+		// Downloads one URL and records the outcome; returns false if it was cut short by cancellation
+		processURL := func(ctx context.Context, urls string) bool {
+			if progress.isDone(urls) { // Completed by an earlier, interrupted run
+				logf(ctx, "Completed in checkpoint, skipping: %s", urls)
+				summaryMutex.Lock()
+				summary.Skipped++
+				summaryMutex.Unlock()
+				return true
+			}
+			started := time.Now()
+			filePath, err := downloader.downloadWithContentRetries(ctx, urls, outputDir, records) // Download the PDF
+			downloaded := err == nil
+			if adaptive != nil && !errors.Is(err, ErrFileExists) && ctx.Err() == nil { // Only real requests say anything about the network
+				adaptive.record(ctx, time.Since(started), isOverloadError(err))
+			}
+			if ctx.Err() != nil && !downloaded { // Cancelled mid-download; retry it next run
+				return false
+			}
+			isPDF := strings.HasSuffix(strings.TrimSuffix(filePath, ".gz"), ".pdf")
+			if downloaded && *validatePDFStructure && isPDF { // Optionally deep-check it, -compress output included
+				if structureErr := checkPDFStructure(filePath); structureErr != nil {
+					quarantineFile(ctx, filePath, outputDir) // Move the broken file out of the archive
+					err = fmt.Errorf("invalid PDF structure: %w", structureErr)
+					downloaded = false // Counted and reported as a failure below
+				}
+			}
+			summaryMutex.Lock()
+			if errors.Is(err, ErrFileExists) {
+				logf(ctx, "File already exists, skipping: %s", filePath)
+				summary.Skipped++
+			} else if errors.Is(err, ErrUnchanged) {
+				logf(ctx, "Unchanged, keeping: %s", filePath)
+				summary.Unchanged++
+			} else if errors.Is(err, ErrAlias) {
+				logf(ctx, "%s serves the same document as %s, skipping", urls, filePath)
+				summary.Skipped++
+				summary.Aliases++
+			} else if err != nil {
+				pages := slices.Clone(discovered.referrers(urls)) // Kept in the summary, apart from the set
+				logf(ctx, "Failed to download %s%s: %v", urls, linkedFrom(pages), err)
+				summary.Failed++
+				summary.Failures = append(summary.Failures, failedDownload{URL: urls, Pages: pages, Error: err.Error()})
+				consecutiveFailures++
+				if *failFast {
+					stopDownloads(errFailFast)
+				} else if *maxConsecutiveFails > 0 && consecutiveFailures >= *maxConsecutiveFails { // Circuit breaker
+					logf(ctx, "%d downloads in a row failed; origin appears broken, aborting", consecutiveFailures)
+					stopDownloads(errOriginBroken)
+				}
+			} else {
+				summary.Downloaded++
+				consecutiveFailures = 0
+			}
+			summaryMutex.Unlock()
+			if *extractText && isPDF && fileExists(filePath) && (downloaded || !fileExists(textPath(filePath))) { // New, or saved before -extract-text was used
+				writeTextExtraction(ctx, filePath)
+			}
+			// Files this download left in the output directory
+			var saved []string
+			if downloaded && fileExists(filePath) { // Index the new file
+				saved = append(saved, filePath)
+				entry := manifestEntry{URL: urls}
+				if identity, found := downloadIdentities.LoadAndDelete(urls); found {
+					entry.Identity = identity.(string)
+				}
+				if pages := discovered.referrers(urls); len(pages) > 0 { // Remember where the document was linked from
+					entry.Source = pages[0]
+					entry.Product = products[pages[0]].Name
+					entry.List = listSources[pages[0]]
+				} else {
+					entry.List = listSources[urls]
+				}
+				changed := records.add(ctx, entry, outputDir, filePath)
+				summaryMutex.Lock()
+				if changed {
+					summary.Changed++
+					summary.ChangedFiles = append(summary.ChangedFiles, recordedPath(outputDir, filePath))
+				}
+				summaryMutex.Unlock()
+			}
+			if entries, found := bundleEntries.LoadAndDelete(urls); found { // PDFs extracted from a zip bundle, kept or not
+				saved = append(saved, entries.([]string)...)
+			}
+			if expectedHashes != nil && len(saved) > 0 { // Check them against the approved set
+				summaryMutex.Lock()
+				for _, path := range saved {
+					name := filepath.Base(path)
+					digest := records.lookup(recordedPath(outputDir, path)).SHA256
+					if want, pinned := expectedHashes[name]; !pinned {
+						logf(ctx, "New document not in -expected-hashes: %s (sha256 %s)", name, digest)
+						summary.Unpinned++
+					} else if digest != want {
+						logf(ctx, "Hash mismatch for %s: expected %s, got %s", name, want, digest)
+						summary.Mismatched++
+					}
+				}
+				summaryMutex.Unlock()
+			}
+			if fileExists(filePath) || (documentArchive != nil && documentArchive.has(filepath.Base(filePath))) { // Downloaded now or already saved
+				progress.markDone(urls)
+			}
+			return true
+		}
+		downloadStarted := time.Now()
+		// Which URLs were fully processed; the rest are pending if the run stops early
+		processed := make([]bool, len(queue))
+		jobs := make(chan int)
+		var capNoted atomic.Bool // Whether the -max-total-bytes stop was logged
+		var workers sync.WaitGroup
+		for workerID := 1; workerID <= workerCount; workerID++ {
+			workerCtx := downloadCtx
+			if workerCount > 1 { // Attribute log lines to workers only when there are several
+				workerCtx = withWorkerID(downloadCtx, workerID)
+			}
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for index := range jobs {
+					if byteCap > 0 && totalBytes.Load() >= byteCap { // Over the byte cap; leave it pending
+						if capNoted.CompareAndSwap(false, true) {
+							logf(workerCtx, "Downloaded %s, reaching -max-total-bytes; not starting further downloads", formatBytes(totalBytes.Load()))
+						}
+						continue
+					}
+					if adaptive == nil {
+						processed[index] = processURL(workerCtx, queue[index])
+					} else if adaptive.acquire() { // Wait for a slot under the current limit
+						processed[index] = processURL(workerCtx, queue[index])
+						adaptive.release()
+					}
+				}
+			}()
+		}
+		// Hand out all resolved PDF URLs until done or the deadline is reached
+	feed:
+		for index := range queue {
+			select {
+			case jobs <- index:
+			case <-downloadCtx.Done(): // Deadline reached or -fail-fast; leave the rest for the next run
+				break feed
+			}
+		}
+		close(jobs)
+		workers.Wait()
+		if len(images) > 0 && downloadCtx.Err() == nil { // Images come after the SDS, which matter more
+			imagesDir := filepath.Join(outputDir, imagesDirname)
+			saved, kept, failed := 0, 0, 0
+			for _, image := range productImages(images) {
+				if downloadCtx.Err() != nil {
+					break
+				}
+				if byteCap > 0 && totalBytes.Load() >= byteCap { // Images count towards -max-total-bytes too
+					if capNoted.CompareAndSwap(false, true) {
+						logf(downloadCtx, "Downloaded %s, reaching -max-total-bytes; not starting further downloads", formatBytes(totalBytes.Load()))
+					}
+					break
+				}
+				filePath, err := downloader.downloadImage(downloadCtx, image, outputDir, records)
+				switch {
+				case errors.Is(err, ErrFileExists):
+					kept++
+				case err != nil:
+					logf(downloadCtx, "Failed to download image %s: %v", image.URL, err)
+					failed++
+				default:
+					debugf(downloadCtx, "Saved image %s → %s", image.URL, filePath)
+					saved++
+				}
+			}
+			log.Printf("Images: %d downloaded, %d already present, %d failed (in %s)", saved, kept, failed, imagesDir)
+		}
+		timings.Download = time.Since(downloadStarted)
+		// URLs left over if the run stopped early
+		var pending []string
+		for index, done := range processed {
+			if !done {
+				pending = append(pending, queue[index])
+			}
+		}
+		records.save()
+		if *reportHTML { // Refresh the browsable index from the manifest
+			reportPath := filepath.Join(outputDir, reportFilename)
+			if err := writeHTMLReport(reportPath, records); err != nil {
+				log.Println(err)
+			} else {
+				log.Printf("Wrote report of %d document(s) to %s", len(records.Entries), reportPath)
+			}
+		}
+		pendingPath := filepath.Join(outputDir, pendingFilename)
+		if len(pending) > 0 || len(unscrapedPages) > 0 { // Stopped early: keep progress and record what is left
+			pending = append(pending, unscrapedPages...)
+			progress.save()
+			if err := writeLines(pendingPath, pending); err != nil {
+				log.Println(err)
+			}
+			summary.Pending = len(pending)
+			summary.Elapsed = time.Since(startTime)
+			summary.Retries = int(retries.used.Load())
+			summary.Replaced = int(replacedFiles.Load())
+			summary.Bytes = totalBytes.Load()
+			cause := context.Cause(downloadCtx)
+			if cause == nil && capNoted.Load() {
+				cause = errByteCapReached
+			}
+			log.Printf("Run stopped early (%v); %d URL(s) written to %s", cause, len(pending), pendingPath)
+			if *showTimings {
+				timings.print(summary)
+			}
+			reportDeadPages(deadPages)
+			reportFailures(summary.Failures)
+			if *pollInterval > 0 {
+				reportChanges(summary.ChangedFiles)
+			}
+			summary.print()
+			if errors.Is(cause, errFailFast) || errors.Is(cause, errOriginBroken) { // A failure, not a cancellation
+				writeSummaryFile("failed", summary, cause)
+				notifyWebhook(downloader.Client, "failed", summary, cause)
+				return exitFailures, nil
+			}
+			if errors.Is(cause, errByteCapReached) { // A limit the user chose; finish normally and leave the rest in pending.txt
+				writeSummaryFile("completed", summary, cause)
+				notifyWebhook(downloader.Client, "completed", summary, cause)
+				if summary.Failed > 0 || (*strictHashes && summary.Mismatched > 0) {
+					return exitFailures, nil
+				}
+				return 0, nil
+			}
+			writeSummaryFile("stopped", summary, cause)
+			notifyWebhook(downloader.Client, "stopped", summary, cause)
+			return exitCancelled, nil
+		}
+		if fileExists(pendingPath) { // Everything was processed this time
+			removeFile(pendingPath)
+		}
+		// The run finished cleanly, so the checkpoint is no longer needed
+		progress.remove()
+		summary.Elapsed = time.Since(startTime)
+		summary.Retries = int(retries.used.Load())
+		summary.Replaced = int(replacedFiles.Load())
+		summary.Bytes = totalBytes.Load()
+		if *showTimings {
+			timings.print(summary)
+		}
+		reportDeadPages(deadPages)
+		reportFailures(summary.Failures)
+		if *pollInterval > 0 {
+			reportChanges(summary.ChangedFiles)
+		}
+		summary.print()
+		writeSummaryFile("completed", summary, nil)
+		notifyWebhook(downloader.Client, "completed", summary, nil)
+		// Move files no longer referenced by any product page out of the archive
+		if *pruneOrphans {
+			downloader.pruneAfterScrape(outputDir, discovered.list(), records, coverage, *pruneConfirm)
+		}
+		if summary.Failed > 0 { // Let CI and scripts see that the archive is incomplete
+			return exitFailures, nil
+		}
+		if *strictHashes && summary.Mismatched > 0 { // Documents no longer match the approved set
+			log.Printf("%d download(s) do not match -expected-hashes", summary.Mismatched)
+			return exitFailures, nil
+		}
+		return 0, nil
+	}
+	if *pollInterval <= 0 {
+		code, err := runCycle(ctx)
+		if err != nil {
+			fatal(err)
+		}
+		if code != 0 {
+			finishRun()
+			os.Exit(code)
+		}
+		return
+	}
+	for cycle := 1; ; cycle++ { // Monitor the site until interrupted
+		log.Printf("===== Poll cycle %d =====", cycle)
+		startTime = time.Now() // Elapsed time, byte and retry counts are per cycle; the manifest and caches carry over
+		totalBytes.Store(0)
+		replacedFiles.Store(0)
+		retries.used.Store(0)
+		code, err := runCycle(ctx)
+		if err != nil { // e.g. the site is briefly down; the monitor tries again next cycle
+			log.Printf("Poll cycle %d failed: %v", cycle, err)
+			summary := runSummary{Elapsed: time.Since(startTime), Retries: int(retries.used.Load())}
+			writeSummaryFile("failed", summary, err)
+			notifyWebhook(downloader.Client, "failed", summary, err)
+		}
+		if ctx.Err() != nil { // Interrupted mid-cycle, or -max-runtime reached
+			finishRun()
+			os.Exit(code)
+		}
+		log.Printf("===== Poll cycle %d finished (exit code %d); next at %s =====", cycle, code, time.Now().Add(*pollInterval).Format(time.DateTime))
+		select {
+		case <-time.After(*pollInterval):
+		case <-ctx.Done(): // Stopped between cycles; nothing is in flight
+			log.Println("Polling stopped")
+			return
 		}
 	}
 }
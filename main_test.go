@@ -0,0 +1,2138 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsDocumentLink(t *testing.T) {
+	tests := []struct {
+		link string
+		want bool
+	}{
+		{"/sds/baz.pdf", true},
+		{"/sds/bar.PDF", true},
+		{"/sds/foo.pdf?utm_source=x", true},
+		{"https://www.nclonline.com/sds/foo.pdf#page=2", true},
+		{"/products/foo", false},
+		{"/sds/foo.pdf.html", false},
+		{"/download?file=foo.pdf", false}, // The extension is in the query, not the path
+	}
+	for _, test := range tests {
+		if got := isDocumentLink(test.link); got != test.want {
+			t.Errorf("isDocumentLink(%q) = %v, want %v", test.link, got, test.want)
+		}
+	}
+}
+
+func TestExtractPDFUrlsKeepsQueryAndUppercaseLinks(t *testing.T) {
+	page := `<a href="/sds/foo.pdf?utm_source=x">a</a> <a href="/sds/bar.PDF">b</a> <a href="/sds/baz.pdf">c</a> <a href="/products/x">d</a>`
+	got := extractPDFUrls(context.Background(), page)
+	want := []string{"/sds/foo.pdf?utm_source=x", "/sds/bar.PDF", "/sds/baz.pdf"}
+	if !slices.Equal(got, want) {
+		t.Errorf("extractPDFUrls = %q, want %q", got, want)
+	}
+}
+
+func TestStripTrackingParamsDedupes(t *testing.T) {
+	patterns := splitList("utm_*,ref,fbclid")
+	links := []string{
+		"https://www.nclonline.com/sds/foo.pdf?utm_source=news&utm_medium=email",
+		"https://www.nclonline.com/sds/foo.pdf?fbclid=abc",
+		"https://www.nclonline.com/sds/foo.pdf?ref=home",
+		"https://www.nclonline.com/sds/foo.pdf",
+	}
+	var stripped []string
+	for _, link := range links {
+		stripped = append(stripped, stripTrackingParams(link, patterns))
+	}
+	got := removeDuplicatesFromSlice(stripped)
+	if want := []string{"https://www.nclonline.com/sds/foo.pdf"}; !slices.Equal(got, want) {
+		t.Errorf("deduplicated = %q, want %q", got, want)
+	}
+}
+
+func TestStripTrackingParamsKeepsOtherParams(t *testing.T) {
+	patterns := splitList("utm_*,ref,fbclid")
+	got := stripTrackingParams("https://www.nclonline.com/sds/foo.pdf?rev=2&utm_source=x", patterns)
+	if want := "https://www.nclonline.com/sds/foo.pdf?rev=2"; got != want {
+		t.Errorf("stripTrackingParams = %q, want %q", got, want)
+	}
+	untouched := "https://www.nclonline.com/sds/foo.pdf?b=2&a=1" // Not re-encoded when nothing is stripped
+	if got := stripTrackingParams(untouched, patterns); got != untouched {
+		t.Errorf("stripTrackingParams = %q, want %q", got, untouched)
+	}
+}
+
+func TestURLToFilename(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://www.nclonline.com/products/view/DUAL_BLEND_1", "dual_blend_1.pdf"},
+		{"https://www.nclonline.com/sds/sds_alpha", "sds_alpha.pdf"},
+		{"https://www.nclonline.com/sds/1_12_SDS_English.pdf", "1_12_sds_english.pdf"},
+		{"https://www.nclonline.com/sds/FOAM%20MAGIC.pdf", "foam_20magic.pdf"},
+		{"https://www.nclonline.com/sds/a--b__c..d", "a_b_c_d.pdf"},        // Runs of separators collapse to one underscore
+		{"https://www.nclonline.com/sds/-_-alpha-_-", "alpha.pdf"},         // Leading and trailing underscores are trimmed
+		{"https://www.nclonline.com/sds/my_pdf_guide.pdf", "my_guide.pdf"}, // "_pdf" is removed anywhere in the name
+		{"foo.pdf", "foo.pdf"},
+		{"FOO.PDF", "foo.pdf"},
+	}
+	for _, test := range tests {
+		if got := urlToFilename(test.url); got != test.want {
+			t.Errorf("urlToFilename(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestURLToFilenameWithoutUsableCharacters(t *testing.T) {
+	first := urlToFilename("https://www.nclonline.com/sds/---")
+	second := urlToFilename("https://www.nclonline.com/docs/***")
+	for _, name := range []string{first, second} {
+		if !regexp.MustCompile(`^document_[0-9a-f]{8}\.pdf$`).MatchString(name) {
+			t.Errorf("got %q, want a document_<hash>.pdf fallback", name)
+		}
+	}
+	if first == second {
+		t.Errorf("different URLs share the fallback name %q", first)
+	}
+	if again := urlToFilename("https://www.nclonline.com/sds/---"); again != first {
+		t.Errorf("fallback name is not stable: %q then %q", first, again)
+	}
+}
+
+// Reads a file from testdata/
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestExtractPDFUrlsFromProductPages(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    []string
+	}{
+		{"product_with_documents.html", []string{
+			"/documents/sds/15_Coconut_Oil_Handsoap_SDS_English.pdf",
+			"/documents/sds/15_Coconut_Oil_Handsoap_SDS_Spanish.pdf",
+			"https://www.nclonline.com/documents/tds/15_Cocount_Oil_TDS_English_GHS.pdf",
+		}},
+		{"product_without_documents.html", nil},
+	}
+	for _, test := range tests {
+		got := extractPDFUrls(context.Background(), readFixture(t, test.fixture))
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: extractPDFUrls = %q, want %q", test.fixture, got, test.want)
+		}
+	}
+}
+
+func TestIsURLValid(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want bool
+	}{
+		{"https://www.nclonline.com/sds/x.pdf", true},
+		{"http://www.nclonline.com/sds/x.pdf", true},
+		{"//cdn/x.pdf", false}, // Scheme-relative; resolvePDFURL makes it absolute first
+		{"/products/x.pdf", false},
+		{"http://", false},
+		{"mailto:sales@nclonline.com", false},
+		{"ftp://www.nclonline.com/x.pdf", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isUrlValid(test.uri); got != test.want {
+			t.Errorf("isUrlValid(%q) = %v, want %v", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestResolvePDFURL(t *testing.T) {
+	page := "https://www.nclonline.com/products/view/DUAL_BLEND_1"
+	tests := []struct {
+		link  string
+		want  string
+		valid bool
+	}{
+		{"//cdn.example.com/x.pdf", "https://cdn.example.com/x.pdf", true}, // Takes the page's scheme
+		{"/products/x.pdf", "https://www.nclonline.com/products/x.pdf", true},
+		{"x.pdf", "https://www.nclonline.com/products/view/x.pdf", true},
+		{"  /sds/x.pdf  ", "https://www.nclonline.com/sds/x.pdf", true},
+		{"https://other.example.com/x.pdf", "https://other.example.com/x.pdf", true},
+		{"mailto:sales@nclonline.com", "mailto:sales@nclonline.com", false},
+		{"http://", "http:", false},
+	}
+	for _, test := range tests {
+		got := resolvePDFURL(page, test.link)
+		if got != test.want {
+			t.Errorf("resolvePDFURL(%q) = %q, want %q", test.link, got, test.want)
+		}
+		if valid := isUrlValid(got); valid != test.valid {
+			t.Errorf("isUrlValid(resolvePDFURL(%q)) = %v, want %v", test.link, valid, test.valid)
+		}
+	}
+}
+
+func TestFilenameModes(t *testing.T) {
+	tests := []struct {
+		url     string
+		strict  string
+		relaxed string
+	}{
+		{"https://www.nclonline.com/products/view/DUAL_BLEND_1", "dual_blend_1.pdf", "DUAL_BLEND_1.pdf"},
+		{"https://www.nclonline.com/sds/Foam-Magic_v1.2.pdf", "foam_magic_v1_2.pdf", "Foam-Magic_v1.2.pdf"},
+		{"https://www.nclonline.com/sds/Foam-Magic_v1-2.pdf", "foam_magic_v1_2.pdf", "Foam-Magic_v1-2.pdf"}, // Collide only in strict mode
+		{"https://www.nclonline.com/sds/FOAM%20MAGIC.PDF?rev=2", "foam_20magic_rev_2.pdf", "FOAM MAGIC.pdf"},
+		{"https://www.nclonline.com/sds/%2E%2Ehidden.pdf", "2e_2ehidden.pdf", "hidden.pdf"},
+		{"My:File*.pdf", "my_file.pdf", "My_File_.pdf"},
+	}
+	for _, test := range tests {
+		if got := urlToFilename(test.url); got != test.strict {
+			t.Errorf("strict(%q) = %q, want %q", test.url, got, test.strict)
+		}
+		if got := relaxedFilename(test.url); got != test.relaxed {
+			t.Errorf("relaxed(%q) = %q, want %q", test.url, got, test.relaxed)
+		}
+	}
+}
+
+func TestRelaxedFilenameWithoutUsableName(t *testing.T) {
+	for _, uri := range []string{"https://www.nclonline.com", "https://www.nclonline.com/", "https://www.nclonline.com/sds/%2F", "..."} {
+		name := relaxedFilename(uri)
+		if !regexp.MustCompile(`^document_[0-9a-f]{8}\.pdf$`).MatchString(name) {
+			t.Errorf("relaxedFilename(%q) = %q, want a document_<hash>.pdf fallback", uri, name)
+		}
+	}
+}
+
+// Holds the lock named by NCL_LOCK_HELPER until killed; started by TestAcquireLockTwoInstances
+func TestLockHelperProcess(t *testing.T) {
+	lockPath := os.Getenv("NCL_LOCK_HELPER")
+	if lockPath == "" {
+		t.Skip("helper process only")
+	}
+	if err := acquireLock(context.Background(), lockPath, false); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("locked")
+	time.Sleep(time.Minute) // Killed by the test without releasing the lock, like a crashed run
+	os.Exit(0)
+}
+
+func TestAcquireLockTwoInstances(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), lockFilename)
+	helper := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+	helper.Env = append(os.Environ(), "NCL_LOCK_HELPER="+lockPath)
+	output, err := helper.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer helper.Process.Kill()
+	line, _ := bufio.NewReader(output).ReadString('\n')
+	if strings.TrimSpace(line) != "locked" {
+		t.Fatalf("helper did not take the lock: %q", line)
+	}
+
+	err = acquireLock(context.Background(), lockPath, false)
+	if err == nil {
+		releaseLock()
+		t.Fatal("second instance took a lock the first one holds")
+	}
+	if want := fmt.Sprintf("pid %d", helper.Process.Pid); !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not name the holder (%s)", err, want)
+	}
+
+	helper.Process.Kill() // Crash: the lockfile stays, but the OS drops the lock
+	helper.Wait()
+	if !fileExists(lockPath) {
+		t.Fatal("lockfile was removed; the crash case is not exercised")
+	}
+	if err := acquireLock(context.Background(), lockPath, false); err != nil {
+		t.Fatalf("lock left by a crashed instance blocks the next run: %v", err)
+	}
+	releaseLock()
+}
+
+func TestAcquireLockWaitsForRelease(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), lockFilename)
+	if err := acquireLock(context.Background(), lockPath, false); err != nil {
+		t.Fatal(err)
+	}
+	first := heldLockFile
+	heldLock, heldLockFile = "", nil // Stand in for a second process: forget this run's lock without releasing it
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := acquireLock(ctx, lockPath, true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting for a held lock returned %v, want the context deadline", err)
+	}
+
+	heldLock, heldLockFile = lockPath, first
+	releaseLock() // Removes the file, then unlocks
+	if err := acquireLock(context.Background(), lockPath, true); err != nil {
+		t.Fatalf("lock not available after release: %v", err)
+	}
+	releaseLock()
+}
+
+func TestAcquireLockEmptyLockfile(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), lockFilename)
+	if err := os.WriteFile(lockPath, nil, 0o644); err != nil { // Left by a crash between creating the file and writing the PID
+		t.Fatal(err)
+	}
+	if err := acquireLock(context.Background(), lockPath, false); err != nil {
+		t.Fatalf("empty lockfile blocks the run: %v", err)
+	}
+	if content, _ := os.ReadFile(lockPath); strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("lockfile holds %q, want this process's PID", content)
+	}
+	releaseLock()
+}
+
+func TestDownloaderNamesFilesWithItsSanitizer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write([]byte("%PDF-1.4\n%%EOF\n"))
+	}))
+	defer server.Close()
+
+	uri := server.URL + "/documents/sds/Foam_Magic_SDS.pdf"
+	tests := []struct {
+		sanitizer Sanitizer
+		want      string
+	}{
+		{urlToFilename, "foam_magic_sds.pdf"},
+		{func(string) string { return "fixed.pdf" }, "fixed.pdf"},
+	}
+	for _, test := range tests {
+		outputDir := t.TempDir()
+		downloader := &Downloader{Client: server.Client(), Sanitizer: test.sanitizer}
+		filePath, err := downloader.downloadPDF(context.Background(), uri, outputDir, loadManifest(filepath.Join(outputDir, "manifest.json")))
+		if err != nil {
+			t.Fatalf("downloadPDF(%q) failed: %v", uri, err)
+		}
+		if want := filepath.Join(outputDir, test.want); filePath != want {
+			t.Errorf("downloadPDF(%q) saved to %s, want %s", uri, filePath, want)
+		}
+		if !fileExists(filePath) {
+			t.Errorf("%s was not written", filePath)
+		}
+	}
+}
+
+// Sends the standard logger to a buffer for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	writer, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestDownloadPathLogsCarryWorkerID(t *testing.T) {
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	saved := filepath.Join(outputDir, "foo.pdf")
+	if err := os.WriteFile(saved, []byte("%PDF-1.4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := withWorkerID(context.Background(), 3)
+	records.add(ctx, manifestEntry{URL: "https://www.nclonline.com/a/foo.pdf"}, outputDir, saved)
+
+	output := captureLog(t)
+	if _, exists := resolveCollision(ctx, saved, "https://www.nclonline.com/b/foo.pdf", outputDir, records); !exists {
+		t.Fatal("colliding URL was not skipped")
+	}
+	if line := output.String(); !strings.HasPrefix(line, "[worker 3] ") || !strings.Contains(line, "skipping colliding") {
+		t.Errorf("collision logged as %q, want it attributed to worker 3", line)
+	}
+}
+
+func TestProductImagesCountsDistinctProducts(t *testing.T) {
+	const (
+		alpha = "https://www.nclonline.com/products/alpha"
+		beta  = "https://www.nclonline.com/products/beta"
+	)
+	images := []productImage{
+		{URL: "https://www.nclonline.com/img/alpha.jpg", Product: alpha},
+		{URL: "https://www.nclonline.com/img/alpha.jpg", Product: alpha}, // Thumbnail and full-size view of the same photo
+		{URL: "https://www.nclonline.com/img/logo.png", Product: alpha},
+		{URL: "https://www.nclonline.com/img/logo.png", Product: beta},
+		{URL: "https://www.nclonline.com/img/beta.jpg", Product: beta},
+	}
+	want := []productImage{
+		{URL: "https://www.nclonline.com/img/alpha.jpg", Product: alpha},
+		{URL: "https://www.nclonline.com/img/beta.jpg", Product: beta},
+	}
+	if got := productImages(images); !slices.Equal(got, want) {
+		t.Errorf("productImages() = %v, want %v", got, want)
+	}
+}
+
+// Builds a minimal well-formed PDF with the given number of blank pages
+func testPDF(pages int) []byte {
+	var objects []string
+	kids := make([]string, pages)
+	for page := range pages {
+		kids[page] = fmt.Sprintf("%d 0 R", page+3)
+	}
+	objects = append(objects, "<< /Type /Catalog /Pages 2 0 R >>")
+	objects = append(objects, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages))
+	for range pages {
+		objects = append(objects, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >>")
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for index, object := range objects {
+		offsets[index] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", index+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// Serves body as a PDF at every path
+func pdfServer(t *testing.T, body []byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Sets a flag or package variable for the rest of the test
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	t.Helper()
+	previous := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = previous })
+}
+
+func TestMinPages(t *testing.T) {
+	tests := []struct {
+		minPages int
+		pages    int
+		rejected bool
+	}{
+		{0, 1, false},
+		{1, 1, false},
+		{1, 0, true},
+		{2, 1, true},
+		{2, 3, false},
+	}
+	for _, test := range tests {
+		if count, err := pdfPageCount(testPDF(test.pages)); err != nil || count != test.pages {
+			t.Fatalf("pdfPageCount(testPDF(%d)) = %d, %v", test.pages, count, err)
+		}
+		setFlag(t, minPages, test.minPages)
+		server := pdfServer(t, testPDF(test.pages))
+		outputDir := t.TempDir()
+		downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+		_, err := downloader.downloadPDF(context.Background(), server.URL+"/doc.pdf", outputDir, loadManifest(filepath.Join(outputDir, "manifest.json")))
+		if rejected := errors.Is(err, ErrTooFewPages); rejected != test.rejected || (!rejected && err != nil) {
+			t.Errorf("-min-pages %d with a %d-page PDF: err = %v, want rejected %v", test.minPages, test.pages, err, test.rejected)
+		}
+	}
+}
+
+// Answers requests with a handler in-process, whatever their scheme and host
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (transport handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	transport.handler.ServeHTTP(recorder, req)
+	response := recorder.Result()
+	response.Request = req
+	return response, nil
+}
+
+func TestGetWithMirrorsFallsBackToHTTP(t *testing.T) {
+	tests := []struct {
+		status    int  // Answer to the https request
+		exhausted bool // Whether -retry-budget is used up
+		want      []string
+	}{
+		{http.StatusOK, false, []string{"https"}},
+		{http.StatusNotFound, false, []string{"https", "http"}},
+		{http.StatusForbidden, false, []string{"https", "http"}},
+		{http.StatusServiceUnavailable, false, []string{"https", "http"}},
+		{http.StatusNotFound, true, []string{"https", "http"}}, // The fallback is not a retry
+	}
+	t.Cleanup(func() {
+		retries.limit = 0
+		retries.used.Store(0)
+	})
+	for _, test := range tests {
+		retries.limit = 0
+		retries.used.Store(0)
+		if test.exhausted {
+			retries.limit = 1
+			retries.used.Store(1)
+		}
+		var requested []string
+		client := &http.Client{Transport: handlerTransport{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested = append(requested, r.URL.Scheme)
+			if r.URL.Scheme == "https" {
+				w.WriteHeader(test.status)
+			}
+			w.Write(testPDF(1))
+		})}}
+		resp, err := getWithMirrors(context.Background(), client, "http://www.nclonline.com/documents/sds/old.pdf")
+		if err != nil {
+			t.Fatalf("https answering %d (budget exhausted %v): %v", test.status, test.exhausted, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !slices.Equal(requested, test.want) {
+			t.Errorf("https answering %d (budget exhausted %v): got %s after requesting %v, want 200 OK after %v", test.status, test.exhausted, resp.Status, requested, test.want)
+		}
+	}
+}
+
+func TestManifestRecordsForwardSlashPaths(t *testing.T) {
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	uris := []string{
+		"https://www.nclonline.com/documents/sds/Foam_Magic_SDS.pdf",
+		"https://www.nclonline.com/documents/tds/Foam Magic TDS.pdf",
+	}
+	for _, uri := range uris {
+		filePath := filepath.Join(outputDir, "quarantine", urlToFilename(uri)) // Nested, so the separator shows
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte("%PDF-1.4\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		records.add(context.Background(), manifestEntry{URL: uri}, outputDir, filePath)
+		if got, want := records.pathFor(uri), "quarantine/"+urlToFilename(uri); got != want {
+			t.Errorf("recorded path for %s = %q, want %q", uri, got, want)
+		}
+	}
+	records.save()
+	if fileExists(records.path + ".tmp") {
+		t.Error("save left its temporary file behind")
+	}
+	reloaded := loadManifest(records.path)
+	if len(reloaded.Entries) != len(uris) {
+		t.Fatalf("reloaded manifest has %d entries, want %d", len(reloaded.Entries), len(uris))
+	}
+	for recorded := range reloaded.Entries {
+		if strings.Contains(recorded, `\`) || !fileExists(filepath.Join(outputDir, filepath.FromSlash(recorded))) {
+			t.Errorf("manifest path %q is not a portable path to the saved file", recorded)
+		}
+	}
+	if got := recordedPath(outputDir, filepath.Join(outputDir, "a", "b", "c.pdf")); got != "a/b/c.pdf" {
+		t.Errorf("recordedPath() = %q, want a/b/c.pdf", got)
+	}
+}
+
+func TestDownloadPDFUsesContentDispositionFilename(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `attachment; filename="Foam Magic SDS.pdf"`)
+		w.Write(testPDF(1))
+	}))
+	defer server.Close()
+	setFlag(t, logLevel, "debug")
+	output := captureLog(t)
+
+	outputDir := t.TempDir()
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	filePath, err := downloader.downloadPDF(context.Background(), server.URL+"/download?id=42", outputDir, loadManifest(filepath.Join(outputDir, "manifest.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(outputDir, "foam_magic_sds.pdf"); filePath != want || !fileExists(want) {
+		t.Errorf("saved to %s, want %s", filePath, want)
+	}
+	if !strings.Contains(output.String(), `content-disposition="attachment; filename=\"Foam Magic SDS.pdf\""`) {
+		t.Errorf("debug log does not show the response headers:\n%s", output)
+	}
+}
+
+func TestDispositionFilename(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{`attachment; filename="Foam Magic SDS.pdf"`, "foam_magic_sds.pdf"}, // Quoted
+		{`attachment; filename=Foam_Magic_SDS.pdf`, "foam_magic_sds.pdf"},   // Unquoted
+		{`attachment; filename*=UTF-8''Foam%20Magic%20SDS.pdf`, "foam_magic_sds.pdf"},
+		{`attachment; filename="../../etc/passwd.pdf"`, "passwd.pdf"}, // Traversal is cut to the last component
+		{`attachment; filename="..\\..\\evil.pdf"`, "evil.pdf"},
+		{`attachment; filename=".."`, ""},
+		{"attachment", ""}, // No filename
+		{"", ""},           // Missing header
+		{"attachment; filename=", ""},
+	}
+	downloader := &Downloader{Sanitizer: urlToFilename}
+	for _, test := range tests {
+		if got := downloader.dispositionFilename(test.header); got != test.want {
+			t.Errorf("dispositionFilename(%q) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+func TestDownloadPDFErrorKinds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.pdf":
+			http.NotFound(w, r)
+		case "/page.pdf":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>Not here</body></html>"))
+		case "/empty.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+		default:
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Write(testPDF(1))
+		}
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close() // Refuses connections
+
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	if _, err := downloader.downloadPDF(context.Background(), server.URL+"/saved.pdf", outputDir, records); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		uri  string
+		want error
+	}{
+		{server.URL + "/page.pdf", ErrNotPDF},
+		{server.URL + "/empty.pdf", ErrEmptyBody},
+		{server.URL + "/saved.pdf", ErrFileExists},
+		{closed.URL + "/gone.pdf", ErrNetwork},
+	}
+	for _, test := range tests {
+		if _, err := downloader.downloadPDF(context.Background(), test.uri, outputDir, records); !errors.Is(err, test.want) {
+			t.Errorf("downloadPDF(%s) = %v, want %v", test.uri, err, test.want)
+		}
+	}
+
+	_, err := downloader.downloadPDF(context.Background(), server.URL+"/missing.pdf", outputDir, records)
+	var status *BadStatusError
+	if !errors.As(err, &status) || status.Code != http.StatusNotFound {
+		t.Errorf("downloadPDF(missing.pdf) = %v, want a BadStatusError with code 404", err)
+	}
+}
+
+// Serves a product page that sets a terms cookie and PDFs only to requests carrying it
+func cookieGateServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/products/") {
+			http.SetCookie(w, &http.Cookie{Name: "terms", Value: "accepted", Path: "/"})
+			w.Write([]byte(`<a href="/documents/sds/gated.pdf">SDS</a>`))
+			return
+		}
+		if cookie, err := r.Cookie("terms"); err != nil || cookie.Value != "accepted" {
+			http.Error(w, "accept the terms first", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(testPDF(1))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCookiesFromScrapeReachDownloads(t *testing.T) {
+	server := cookieGateServer(t)
+	downloader := &Downloader{Client: newHTTPClient(), Sanitizer: urlToFilename}
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	uri := server.URL + "/documents/sds/gated.pdf"
+
+	var status *BadStatusError
+	if _, err := downloader.downloadPDF(context.Background(), uri, outputDir, records); !errors.As(err, &status) || status.Code != http.StatusForbidden {
+		t.Fatalf("download before the scrape = %v, want 403", err)
+	}
+	downloader.getDataFromURL(context.Background(), server.URL+"/products/gated")
+	if _, err := downloader.downloadPDF(context.Background(), uri, outputDir, records); err != nil {
+		t.Errorf("download after the scrape set the cookie: %v", err)
+	}
+}
+
+func TestSeedCookieJar(t *testing.T) {
+	server := cookieGateServer(t)
+	setFlag(t, &baseURL, server.URL)
+	downloader := &Downloader{Client: newHTTPClient(), Sanitizer: urlToFilename}
+	if err := seedCookieJar(downloader.Client, []string{"terms=accepted"}); err != nil {
+		t.Fatal(err)
+	}
+	outputDir := t.TempDir()
+	if _, err := downloader.downloadPDF(context.Background(), server.URL+"/documents/sds/gated.pdf", outputDir, loadManifest(filepath.Join(outputDir, "manifest.json"))); err != nil {
+		t.Errorf("download with a seeded cookie: %v", err)
+	}
+	if err := seedCookieJar(downloader.Client, []string{"no equals sign"}); err == nil {
+		t.Error("seedCookieJar accepted a malformed -cookie value")
+	}
+}
+
+func TestOnCollisionSuffix(t *testing.T) {
+	server := pdfServer(t, testPDF(1))
+	setFlag(t, onCollision, "suffix")
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	uris := []string{server.URL + "/sds/Foo.pdf", server.URL + "/tds/foo.pdf", server.URL + "/flyers/FOO.pdf"} // All named foo.pdf
+	for index, uri := range uris {
+		filePath, err := downloader.downloadPDF(context.Background(), uri, outputDir, records)
+		if err != nil {
+			t.Fatalf("downloadPDF(%s): %v", uri, err)
+		}
+		records.add(context.Background(), manifestEntry{URL: uri}, outputDir, filePath)
+		want := "foo.pdf"
+		if index > 0 {
+			want = fmt.Sprintf("foo_%d.pdf", index+1)
+		}
+		if got := records.pathFor(uri); got != want {
+			t.Errorf("%s recorded as %q, want %q", uri, got, want)
+		}
+	}
+	filePath, err := downloader.downloadPDF(context.Background(), uris[1], outputDir, records) // A later run finds its own suffixed copy
+	if !errors.Is(err, ErrFileExists) || filePath != filepath.Join(outputDir, "foo_2.pdf") {
+		t.Errorf("second run of %s = %s, %v; want foo_2.pdf, ErrFileExists", uris[1], filePath, err)
+	}
+}
+
+func TestOnCollisionSkipKeepsFirst(t *testing.T) {
+	server := pdfServer(t, testPDF(1))
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	filePath, err := downloader.downloadPDF(context.Background(), server.URL+"/sds/Foo.pdf", outputDir, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records.add(context.Background(), manifestEntry{URL: server.URL + "/sds/Foo.pdf"}, outputDir, filePath)
+	if _, err := downloader.downloadPDF(context.Background(), server.URL+"/tds/foo.pdf", outputDir, records); !errors.Is(err, ErrFileExists) {
+		t.Errorf("colliding download = %v, want ErrFileExists under the default -on-collision skip", err)
+	}
+}
+
+func TestDialNetwork(t *testing.T) {
+	for version, want := range map[string]string{"auto": "tcp", "4": "tcp4", "6": "tcp6"} {
+		if got, err := dialNetwork(version); err != nil || got != want {
+			t.Errorf("dialNetwork(%q) = %q, %v; want %q", version, got, err, want)
+		}
+	}
+	for _, version := range []string{"", "ipv4", "46"} {
+		if _, err := dialNetwork(version); err == nil {
+			t.Errorf("dialNetwork(%q) accepted an invalid -ip-version", version)
+		}
+	}
+}
+
+func TestRestrictAddressFamily(t *testing.T) {
+	server := pdfServer(t, testPDF(1)) // Listens on 127.0.0.1
+	for network, reachable := range map[string]bool{"tcp4": true, "tcp6": false} {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		restrictAddressFamily(transport, network)
+		client := &http.Client{Transport: transport}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != reachable {
+			t.Errorf("%s client reaching an IPv4 server: err = %v, want reachable %v", network, err, reachable)
+		}
+	}
+}
+
+func TestRedirectLoopAndLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/loop/a":
+			http.Redirect(w, r, "/loop/b", http.StatusFound)
+		case r.URL.Path == "/loop/b":
+			http.Redirect(w, r, "/loop/a", http.StatusFound)
+		case strings.HasPrefix(r.URL.Path, "/chain/"): // /chain/1 → /chain/2 → ...
+			step, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/chain/"))
+			http.Redirect(w, r, fmt.Sprintf("/chain/%d", step+1), http.StatusFound)
+		}
+	}))
+	defer server.Close()
+	setFlag(t, maxRedirects, 3)
+	client := newHTTPClient()
+	output := captureLog(t)
+
+	_, err := client.Get(server.URL + "/loop/a")
+	if err == nil || !strings.Contains(err.Error(), "redirect loop back to "+server.URL+"/loop/a") {
+		t.Errorf("looping redirect: err = %v, want a redirect loop error", err)
+	}
+	if want := "Redirect loop: " + server.URL + "/loop/a → " + server.URL + "/loop/b → " + server.URL + "/loop/a"; !strings.Contains(output.String(), want) {
+		t.Errorf("log %q does not show the chain %q", output, want)
+	}
+
+	_, err = client.Get(server.URL + "/chain/1")
+	if err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+		t.Errorf("long redirect chain: err = %v, want it stopped after 3 redirects", err)
+	}
+	if !strings.Contains(output.String(), "Too many redirects: "+server.URL+"/chain/1 → ") {
+		t.Errorf("log %q does not show the redirect chain", output)
+	}
+}
+
+func TestBaseURLRewritesProductAndPDFURLs(t *testing.T) {
+	base, err := parseBaseURL("http://staging.example:8080/ignored/path")
+	if err != nil || base != "http://staging.example:8080" {
+		t.Fatalf("parseBaseURL() = %q, %v", base, err)
+	}
+	setFlag(t, &baseURL, base)
+
+	page := rebaseURL("https://www.nclonline.com/products/view/DUAL_BLEND_1")
+	if want := "http://staging.example:8080/products/view/DUAL_BLEND_1"; page != want {
+		t.Errorf("product URL rebased to %q, want %q", page, want)
+	}
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"/documents/sds/Dual_Blend_SDS.pdf", "http://staging.example:8080/documents/sds/Dual_Blend_SDS.pdf"},
+		{"../flyers/Dual_Blend.pdf", "http://staging.example:8080/products/flyers/Dual_Blend.pdf"},
+		{"https://www.nclonline.com/documents/tds/Dual_Blend_TDS.pdf", "http://staging.example:8080/documents/tds/Dual_Blend_TDS.pdf"},
+		{"https://cdn.example.com/Dual_Blend.pdf", "https://cdn.example.com/Dual_Blend.pdf"}, // Other hosts are not the site
+	}
+	for _, test := range tests {
+		if got := resolvePDFURL(page, test.link); got != test.want {
+			t.Errorf("resolvePDFURL(%q, %q) = %q, want %q", page, test.link, got, test.want)
+		}
+	}
+}
+
+func TestParseBaseURLRejectsInvalid(t *testing.T) {
+	for _, value := range []string{"staging.example", "ftp://staging.example", "http://", "not a url", "http://[::1"} {
+		if base, err := parseBaseURL(value); err == nil {
+			t.Errorf("parseBaseURL(%q) = %q, want an error", value, base)
+		}
+	}
+}
+
+func TestDownloadPDFSniffsMislabeledContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.pdf":
+			w.Header()["Content-Type"] = nil // Stops the server from sniffing one in
+		case "/wrong.pdf":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		case "/page.pdf":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("Document not found"))
+			return
+		}
+		w.Write(testPDF(1))
+	}))
+	defer server.Close()
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	for _, name := range []string{"missing.pdf", "wrong.pdf"} {
+		if _, err := downloader.downloadPDF(context.Background(), server.URL+"/"+name, outputDir, records); err != nil {
+			t.Errorf("PDF served as %s rejected: %v", name, err)
+		}
+	}
+	if _, err := downloader.downloadPDF(context.Background(), server.URL+"/page.pdf", outputDir, records); !errors.Is(err, ErrNotPDF) {
+		t.Errorf("text served as text/plain = %v, want ErrNotPDF", err)
+	}
+}
+
+func TestNormalizeHTML(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"<a href=\"/sds/\n   FOO.pdf \">SDS</a>", `<a href="/sds/FOO.pdf">SDS</a>`},
+		{"<a href = '\r\n\t/sds/foo.pdf'>", `<a href ='/sds/foo.pdf'>`},
+		{"<a class=\"btn  primary\" href=\"/x.pdf\">", `<a class="btn  primary" href="/x.pdf">`}, // Spaces inside a line are kept
+		{"<p>Text\n  between tags</p>", "<p>Text\n  between tags</p>"},
+		{"<script>x = \"a\n b\"</script>", "<script>x = \"a\n b\"</script>"},                 // Script content is not markup
+		{"<p>Set size = \"large\n  \" first</p>", "<p>Set size = \"large\n  \" first</p>"},   // Nor is text
+		{"<!-- a = 'b\n c' --><a href='\n/x.pdf'>", "<!-- a = 'b\n c' --><a href='/x.pdf'>"}, // Comments are kept too
+		{"<a href=\"/x.pdf\"", "<a href=\"/x.pdf\""},                                         // Unterminated tag at the end
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := normalizeHTML(test.in); got != test.want {
+			t.Errorf("normalizeHTML(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+	page := normalizeHTML("<a href=\"/documents/sds/\n    Foam_Magic_SDS.pdf\n\">SDS</a>")
+	if got, want := extractPDFUrls(context.Background(), page), []string{"/documents/sds/Foam_Magic_SDS.pdf"}; !slices.Equal(got, want) {
+		t.Errorf("extractPDFUrls(normalized page) = %v, want %v", got, want)
+	}
+}
+
+func TestMaxBandwidthHoldsInAggregate(t *testing.T) {
+	const (
+		rate    = 200 << 10 // 200 KiB/s
+		size    = 30 << 10
+		workers = 4
+	)
+	body := append(testPDF(1), bytes.Repeat([]byte(" "), size-len(testPDF(1)))...)
+	server := pdfServer(t, body)
+	setFlag(t, &bandwidth, &bandwidthLimiter{rate: rate, last: time.Now()})
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+
+	started := time.Now()
+	errs := make(chan error, workers)
+	for worker := range workers {
+		go func() {
+			_, err := downloader.downloadPDF(context.Background(), fmt.Sprintf("%s/doc%d.pdf", server.URL, worker), outputDir, records)
+			errs <- err
+		}()
+	}
+	for range workers {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(started)
+	if want := time.Duration(float64(workers*size) / rate * float64(time.Second)); elapsed < want*9/10 {
+		t.Errorf("%d downloads of %d bytes took %s at -max-bandwidth %d/s, want at least %s", workers, size, elapsed, rate, want)
+	}
+}
+
+func TestURLSetConcurrentAdds(t *testing.T) {
+	const (
+		pages = 8
+		links = 50
+	)
+	set := newURLSet()
+	var added atomic.Int64
+	var workers sync.WaitGroup
+	for page := range pages { // Every page links the same documents, as product families do
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for link := range links {
+				if set.add(fmt.Sprintf("https://www.nclonline.com/sds/%d.pdf", link), fmt.Sprintf("https://www.nclonline.com/products/view/%d", page)) {
+					added.Add(1)
+				}
+				set.referrers(fmt.Sprintf("https://www.nclonline.com/sds/%d.pdf", link))
+			}
+		}()
+	}
+	workers.Wait()
+	if added.Load() != links || len(set.list()) != links {
+		t.Errorf("%d URL(s) reported new and %d listed, want %d of each", added.Load(), len(set.list()), links)
+	}
+	for uri, referrers := range set.references() {
+		if len(referrers) != pages {
+			t.Errorf("%s has %d referring page(s), want %d", uri, len(referrers), pages)
+		}
+	}
+}
+
+func TestExtractFromFlyerSection(t *testing.T) {
+	const pageURL = "https://www.nclonline.com/products/flyer_alpha.php"
+	var got []string
+	for _, link := range extractPDFUrls(context.Background(), readFixture(t, "flyer_page.html")) {
+		got = append(got, resolvePDFURL(pageURL, link))
+	}
+	want := []string{
+		"https://www.nclonline.com/products/flyers/24_7_Flyer.pdf",
+		"https://www.nclonline.com/documents/flyers/AFIA_Alcohol_Based_Foaming_Hand_Sanitizer_Flyer.pdf",
+		"https://www.nclonline.com/documents/sds/Dual_Blend_SDS_English.pdf",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("links on %s resolved to %q, want %q", pageURL, got, want)
+	}
+}
+
+func TestDownloadPDFKeepsLastModified(t *testing.T) {
+	modified := time.Date(2015, time.October, 21, 7, 28, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dated.pdf":
+			w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		case "/garbled.pdf":
+			w.Header().Set("Last-Modified", "last tuesday")
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(testPDF(1))
+	}))
+	defer server.Close()
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+
+	started := time.Now().Add(-time.Second) // Filesystem times may be coarser than the clock
+	for _, name := range []string{"dated.pdf", "undated.pdf", "garbled.pdf"} {
+		filePath, err := downloader.downloadPDF(context.Background(), server.URL+"/"+name, outputDir, records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "dated.pdf" && !info.ModTime().Equal(modified) {
+			t.Errorf("%s modified at %s, want the Last-Modified time %s", name, info.ModTime(), modified)
+		} else if name != "dated.pdf" && info.ModTime().Before(started) {
+			t.Errorf("%s modified at %s, want the download time", name, info.ModTime())
+		}
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	body := testPDF(2)
+	server := pdfServer(t, body)
+	setFlag(t, compressPDFs, true)
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	uri := server.URL + "/sds/foam.pdf"
+
+	filePath, err := downloader.downloadPDF(context.Background(), uri, outputDir, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(outputDir, "foam.pdf.gz"); filePath != want || fileExists(filepath.Join(outputDir, "foam.pdf")) {
+		t.Fatalf("saved to %s, want only %s", filePath, want)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decompressor, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := io.ReadAll(decompressor)
+	if err != nil || !bytes.Equal(restored, body) || decompressor.Name != "foam.pdf" {
+		t.Errorf("gunzip gave %d byte(s) named %q (err %v), want the %d downloaded bytes named foam.pdf", len(restored), decompressor.Name, err, len(body))
+	}
+	if same, err := sameContent(filePath, body); err != nil || !same {
+		t.Errorf("sameContent(%s) = %v, %v; want true", filePath, same, err)
+	}
+
+	records.add(context.Background(), manifestEntry{URL: uri}, outputDir, filePath)
+	if got := records.pathFor(uri); got != "foam.pdf.gz" {
+		t.Errorf("manifest records %q, want foam.pdf.gz", got)
+	}
+	setFlag(t, compressPDFs, false) // The .gz copy still counts as downloaded
+	if _, err := downloader.downloadPDF(context.Background(), uri, outputDir, records); !errors.Is(err, ErrFileExists) {
+		t.Errorf("download over a compressed copy = %v, want ErrFileExists", err)
+	}
+}
+
+func TestHTTPCacheRevalidatesWithETag(t *testing.T) {
+	const page = `<a href="/documents/sds/Foam_Magic_SDS.pdf">SDS</a>`
+	var mutex sync.Mutex
+	var served []string // Status sent for each request to /products/*
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.URL.Path {
+		case "/products/revalidated":
+			w.Header().Set("Cache-Control", "no-cache")
+		case "/products/fresh":
+			w.Header().Set("Cache-Control", "max-age=3600")
+		case "/products/uncacheable":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			served = append(served, r.URL.Path+" 304")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		served = append(served, r.URL.Path+" 200")
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	setFlag(t, httpCacheDir, t.TempDir())
+
+	for _, path := range []string{"/products/revalidated", "/products/fresh", "/products/uncacheable"} {
+		for range 2 {
+			if got, err := downloader.getDataFromURL(context.Background(), server.URL+path); got != page || err != nil {
+				t.Errorf("getDataFromURL(%s) = %q, %v; want the page body", path, got, err)
+			}
+		}
+	}
+	want := []string{
+		"/products/revalidated 200", "/products/revalidated 304", // Cached body reused after a 304
+		"/products/fresh 200", // Served from the cache without a request
+		"/products/uncacheable 200", "/products/uncacheable 200",
+	}
+	if !slices.Equal(served, want) {
+		t.Errorf("server answered %q, want %q", served, want)
+	}
+}
+
+func TestRemoveDuplicatesFromSliceCollapsesNearDuplicates(t *testing.T) {
+	pages := []string{
+		"https://www.nclonline.com/products/view/DUAL_BLEND_1",
+		"https://www.nclonline.com/products/view/DUAL_BLEND_1/",
+		"https://WWW.NCLONLINE.COM/products/view/DUAL_BLEND_1",
+		"https://www.nclonline.com/products/view/DUAL_BLEND_1#documents",
+		" https://www.nclonline.com/products/view/DUAL_BLEND_1 ",
+		"https://www.nclonline.com/products/view/dual_blend_1", // Paths are case-sensitive
+		"https://www.nclonline.com/products/view/24_7_",
+	}
+	want := []string{
+		"https://www.nclonline.com/products/view/DUAL_BLEND_1",
+		"https://www.nclonline.com/products/view/dual_blend_1",
+		"https://www.nclonline.com/products/view/24_7_",
+	}
+	if got := removeDuplicatesFromSlice(pages); !slices.Equal(got, want) {
+		t.Errorf("removeDuplicatesFromSlice() = %q, want %q", got, want)
+	}
+}
+
+func TestNonUTF8PagesAreDecoded(t *testing.T) {
+	page := readFixture(t, "product_windows_1252.html")
+	want := []string{
+		"/documents/sds/Crème_Nettoyante_SDS_Français.pdf",
+		"/documents/tds/Crème_Nettoyante_TDS.pdf",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/labeled" { // Otherwise only the <meta charset> names the encoding
+			w.Header().Set("Content-Type", "text/html; charset=windows-1252")
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+		}
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	for _, path := range []string{"/labeled", "/meta"} {
+		content, err := downloader.getDataFromURL(context.Background(), server.URL+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := extractPDFUrls(context.Background(), content); !slices.Equal(got, want) {
+			t.Errorf("%s: extracted %q, want %q", path, got, want)
+		}
+	}
+	decoded, err := io.ReadAll(decodingReader(context.Background(), strings.NewReader(page), "text/html")) // As -stream-pages reads pages
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := extractPDFUrls(context.Background(), string(decoded)); !slices.Equal(got, want) {
+		t.Errorf("streamed: extracted %q, want %q", got, want)
+	}
+}
+
+func TestFollowMetaRefresh(t *testing.T) {
+	pages := map[string]string{
+		"/products/view/15_COCONUT":     readFixture(t, "meta_refresh.html"),
+		"/products/view/15_COCONUT_OIL": readFixture(t, "product_with_documents.html"),
+		"/loop/a":                       `<meta http-equiv="refresh" content="0;url=/loop/b">`,
+		"/loop/b":                       `<meta http-equiv="refresh" content="0;url=/loop/a">`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(pages[r.URL.Path]))
+	}))
+	defer server.Close()
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+
+	pageURL, content, err := downloader.followMetaRefresh(context.Background(), server.URL+"/products/view/15_COCONUT", pages["/products/view/15_COCONUT"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := server.URL + "/products/view/15_COCONUT_OIL"; pageURL != want {
+		t.Errorf("followed the meta refresh to %s, want %s", pageURL, want)
+	}
+	want := []string{
+		"/documents/sds/15_Coconut_Oil_Handsoap_SDS_English.pdf",
+		"/documents/sds/15_Coconut_Oil_Handsoap_SDS_Spanish.pdf",
+		"https://www.nclonline.com/documents/tds/15_Cocount_Oil_TDS_English_GHS.pdf",
+	}
+	if got := extractPDFUrls(context.Background(), content); !slices.Equal(got, want) {
+		t.Errorf("links behind the meta refresh = %q, want %q", got, want)
+	}
+
+	done := make(chan string)
+	go func() {
+		pageURL, _, _ := downloader.followMetaRefresh(context.Background(), server.URL+"/loop/a", pages["/loop/a"])
+		done <- pageURL
+	}()
+	select {
+	case pageURL := <-done:
+		if want := server.URL + "/loop/b"; pageURL != want {
+			t.Errorf("refresh loop stopped at %s, want %s", pageURL, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("followMetaRefresh did not stop on a refresh loop")
+	}
+}
+
+// Minimal SOCKS5 proxy (RFC 1928) requiring username/password authentication
+// (RFC 1929). Returns its address and a channel receiving each target it connects.
+func socks5Proxy(t *testing.T, username, password string) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	targets := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				read := func(n int) []byte { // Zeros once the client hangs up, which fails the checks below
+					buf := make([]byte, n)
+					io.ReadFull(reader, buf)
+					return buf
+				}
+				greeting := read(2) // Version, number of methods
+				if !slices.Contains(read(int(greeting[1])), 0x02) {
+					conn.Write([]byte{5, 0xff})
+					return
+				}
+				conn.Write([]byte{5, 0x02}) // Username/password
+				header := read(2)           // Subnegotiation version, username length
+				user := string(read(int(header[1])))
+				pass := string(read(int(read(1)[0])))
+				if user != username || pass != password {
+					conn.Write([]byte{1, 1})
+					return
+				}
+				conn.Write([]byte{1, 0})
+				request := read(4) // Version, command, reserved, address type
+				var host string
+				switch request[3] {
+				case 1:
+					host = net.IP(read(4)).String()
+				case 3:
+					host = string(read(int(read(1)[0])))
+				case 4:
+					host = net.IP(read(16)).String()
+				}
+				port := read(2)
+				target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				targets <- target
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(upstream, reader)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return listener.Addr().String(), targets
+}
+
+func TestConfigureProxySOCKS5WithCredentials(t *testing.T) {
+	server := pdfServer(t, testPDF(1))
+	proxyAddress, targets := socks5Proxy(t, "ncl", "s3cret")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if err := configureProxy(transport, "socks5://ncl:s3cret@"+proxyAddress); err != nil {
+		t.Fatal(err)
+	}
+	downloader := &Downloader{Client: &http.Client{Transport: transport}, Sanitizer: urlToFilename}
+	outputDir := t.TempDir()
+	if _, err := downloader.downloadPDF(context.Background(), server.URL+"/sds/proxied.pdf", outputDir, loadManifest(filepath.Join(outputDir, "manifest.json"))); err != nil {
+		t.Fatalf("download through the SOCKS5 proxy: %v", err)
+	}
+	if target := <-targets; target != server.Listener.Addr().String() {
+		t.Errorf("proxy connected to %s, want %s", target, server.Listener.Addr())
+	}
+
+	transport = http.DefaultTransport.(*http.Transport).Clone()
+	if err := configureProxy(transport, "socks5://ncl:wrong@"+proxyAddress); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Error("SOCKS5 proxy accepted a wrong password")
+	}
+}
+
+func TestConfigureProxyHTTPWithCredentials(t *testing.T) {
+	var authorization string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Proxy-Authorization") // A forward proxy sees the full target URL
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(testPDF(1))
+	}))
+	defer proxyServer.Close()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if err := configureProxy(transport, strings.Replace(proxyServer.URL, "http://", "http://ncl:s3cret@", 1)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://documents.invalid/sds/proxied.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := "Basic bmNsOnMzY3JldA=="; authorization != want { // base64("ncl:s3cret")
+		t.Errorf("Proxy-Authorization = %q, want %q", authorization, want)
+	}
+
+	for _, value := range []string{"ftp://proxy:21", "socks5://", "://nohost"} {
+		if err := configureProxy(http.DefaultTransport.(*http.Transport).Clone(), value); err == nil {
+			t.Errorf("configureProxy(%q) accepted an invalid -proxy", value)
+		}
+	}
+}
+
+// Compares peak memory of reading a large page into a string before extracting
+// links with extracting while the page streams in. Compare B/op:
+// go test -run '^$' -bench BenchmarkExtractPDFUrls -benchmem
+func BenchmarkExtractPDFUrls(b *testing.B) {
+	var page strings.Builder
+	page.WriteString("<html><body><ul>")
+	for index := range 20000 { // About 2 MB, a large catalog page
+		fmt.Fprintf(&page, `<li class="product"><a href="/products/view/P%d">Product %d</a> <a href="/documents/sds/P%d_SDS.pdf">SDS</a></li>`, index, index, index)
+	}
+	page.WriteString("</ul></body></html>")
+	body := []byte(page.String())
+
+	b.Run("in-memory", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for b.Loop() {
+			content, err := io.ReadAll(bytes.NewReader(body)) // As getDataFromURL reads the response
+			if err != nil {
+				b.Fatal(err)
+			}
+			extractPDFUrls(context.Background(), string(content))
+		}
+	})
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for b.Loop() {
+			extractPDFUrlsFrom(context.Background(), bytes.NewReader(body))
+		}
+	})
+}
+
+// Fills a directory with count documents of size bytes each
+func writeDocuments(tb testing.TB, dir string, count int, size int) {
+	tb.Helper()
+	data := make([]byte, size)
+	for index := range count {
+		for offset := range data { // Different content per file
+			data[offset] = byte(offset*31 + index)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("doc_%03d.pdf", index)), data, 0o644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func TestHashDirectoryParallelMatchesSerial(t *testing.T) {
+	dir := t.TempDir()
+	writeDocuments(t, dir, 20, 4096)
+	serial, err := hashDirectory(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parallel, err := hashDirectory(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serial) != 20 || !maps.Equal(serial, parallel) {
+		t.Errorf("hashing on 8 workers gave %d digest(s) differing from the %d serial ones", len(parallel), len(serial))
+	}
+}
+
+// Hashing an archive on 1 to 8 workers; the speedup levels off at the core count:
+// go test -run '^$' -bench BenchmarkHashDirectory
+func BenchmarkHashDirectory(b *testing.B) {
+	const (
+		count = 64
+		size  = 1 << 20
+	)
+	dir := b.TempDir()
+	writeDocuments(b, dir, count, size)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(count * size)
+			for b.Loop() {
+				if _, err := hashDirectory(dir, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadPDFContentLengthMismatch(t *testing.T) {
+	body := testPDF(1)
+	client := &http.Client{Transport: handlerTransport{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)+100)) // As a proxy that altered the body would leave it
+		w.Write(body)
+	})}}
+	output := captureLog(t)
+	outputDir := t.TempDir()
+	downloader := &Downloader{Client: client, Sanitizer: urlToFilename}
+	filePath, err := downloader.downloadPDF(context.Background(), "http://documents.invalid/sds/altered.pdf", outputDir, loadManifest(filepath.Join(outputDir, "manifest.json")))
+	if err != nil || !fileExists(filePath) {
+		t.Fatalf("mismatched download = %s, %v; want the file kept", filePath, err)
+	}
+	if want := fmt.Sprintf("WARNING: received %d bytes from http://documents.invalid/sds/altered.pdf but Content-Length was %d", len(body), len(body)+100); !strings.Contains(output.String(), want) {
+		t.Errorf("log %q does not contain %q", output, want)
+	}
+}
+
+func TestDownloadPDFTruncatedBody(t *testing.T) {
+	body := testPDF(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffered, err := http.NewResponseController(w).Hijack() // Cut the connection mid-body
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buffered, "HTTP/1.1 200 OK\r\nContent-Type: application/pdf\r\nContent-Length: %d\r\n\r\n", len(body)+100)
+		buffered.Write(body)
+		buffered.Flush()
+	}))
+	defer server.Close()
+	outputDir := t.TempDir()
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	_, err := downloader.downloadPDF(context.Background(), server.URL+"/truncated.pdf", outputDir, loadManifest(filepath.Join(outputDir, "manifest.json")))
+	if want := fmt.Sprintf("received %d of %d bytes", len(body), len(body)+100); !errors.Is(err, ErrNetwork) || !strings.Contains(err.Error(), want) {
+		t.Errorf("truncated download = %v, want ErrNetwork mentioning %q", err, want)
+	}
+	if fileExists(filepath.Join(outputDir, "truncated.pdf")) {
+		t.Error("truncated download was saved")
+	}
+}
+
+func TestPrepareOutputDirectory(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "archive", "2026", "PDFs")
+	if err := prepareOutputDirectory(nested); err != nil || !directoryExists(nested) {
+		t.Fatalf("prepareOutputDirectory(%s) = %v, want the nested path created", nested, err)
+	}
+	if err := checkWritable(nested); err != nil {
+		t.Errorf("checkWritable(%s) = %v", nested, err)
+	}
+
+	file := filepath.Join(root, "file.pdf")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareOutputDirectory(file); err == nil || !strings.Contains(err.Error(), "is not a directory") {
+		t.Errorf("prepareOutputDirectory(file) = %v, want a not-a-directory error", err)
+	}
+	linked, broken := filepath.Join(root, "linked"), filepath.Join(root, "broken")
+	if err := os.Symlink(nested, linked); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	if err := prepareOutputDirectory(linked); err != nil {
+		t.Errorf("prepareOutputDirectory(symlink to a directory) = %v", err)
+	}
+	os.Symlink(file, broken)
+	if err := prepareOutputDirectory(broken); err == nil || !strings.Contains(err.Error(), "is a symlink to "+file) {
+		t.Errorf("prepareOutputDirectory(symlink to a file) = %v, want the symlink named", err)
+	}
+}
+
+func TestCheckWritableReadOnly(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("directory permissions are not enforced here")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0o755) // So the temporary directory can be removed
+	if err := checkWritable(dir); err == nil || !strings.Contains(err.Error(), "is not writable") {
+		t.Errorf("checkWritable(read-only directory) = %v, want a not-writable error", err)
+	}
+}
+
+func TestExtractPDFUrlsFromEmbeddedViewers(t *testing.T) {
+	const pageURL = "https://www.nclonline.com/products/view/DUAL_BLEND_1"
+	links := extractPDFUrls(context.Background(), readFixture(t, "embedded_viewer.html"))
+	want := []string{
+		"/documents/sds/Dual_Blend_1_SDS_English.pdf", // The download link
+		"/documents/sds/Dual_Blend_1_SDS_English.pdf", // The same document in an iframe
+		"/documents/sds/Dual_Blend_1_SDS_Spanish.pdf",
+		"/documents/tds/Dual_Blend_1_TDS.pdf#toolbar=0",
+	}
+	if !slices.Equal(links, want) {
+		t.Fatalf("extractPDFUrls = %q, want %q", links, want)
+	}
+	discovered := newURLSet() // As the scrape records them
+	for _, link := range links {
+		discovered.add(resolvePDFURL(pageURL, link), pageURL)
+	}
+	want = []string{
+		"https://www.nclonline.com/documents/sds/Dual_Blend_1_SDS_English.pdf",
+		"https://www.nclonline.com/documents/sds/Dual_Blend_1_SDS_Spanish.pdf",
+		"https://www.nclonline.com/documents/tds/Dual_Blend_1_TDS.pdf#toolbar=0",
+	}
+	if got := discovered.list(); !slices.Equal(got, want) {
+		t.Errorf("discovered %q, want %q", got, want)
+	}
+}
+
+func TestParsePermissions(t *testing.T) {
+	for value, want := range map[string]os.FileMode{"664": 0o664, "0775": 0o775, "0o640": 0o640, "0": 0} {
+		if got, err := parsePermissions(value); err != nil || got != want {
+			t.Errorf("parsePermissions(%q) = %o, %v; want %o", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "rw-r--r--", "644x", "0o1777", "888", "-644"} {
+		if _, err := parsePermissions(value); err == nil {
+			t.Errorf("parsePermissions(%q) accepted an invalid mode", value)
+		}
+	}
+}
+
+func TestFileAndDirModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix permission bits are not kept on Windows")
+	}
+	root := t.TempDir()
+	probe := filepath.Join(root, "probe")
+	if err := os.Mkdir(probe, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	umask := 0o777 &^ info.Mode().Perm() // Whatever the process umask strips
+
+	setFlag(t, &fileMode, 0o660) // Group-writable and not world-readable, as for a shared archive; differs from the 0644 default
+	setFlag(t, &dirMode, 0o775)
+	outputDir := filepath.Join(root, "shared", "PDFs")
+	if err := prepareOutputDirectory(outputDir); err != nil {
+		t.Fatal(err)
+	}
+	server := pdfServer(t, testPDF(1))
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	filePath, err := downloader.downloadPDF(context.Background(), server.URL+"/sds/shared.pdf", outputDir, loadManifest(filepath.Join(outputDir, "manifest.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockPath := filepath.Join(outputDir, lockFilename)
+	if err := acquireLock(context.Background(), lockPath, false); err != nil {
+		t.Fatal(err)
+	}
+	defer releaseLock()
+	for path, mode := range map[string]os.FileMode{filePath: fileMode, lockPath: fileMode, outputDir: dirMode, filepath.Dir(outputDir): dirMode} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := mode &^ umask; info.Mode().Perm() != want {
+			t.Errorf("%s has mode %o, want %o (%o under umask %03o)", path, info.Mode().Perm(), want, mode, umask)
+		}
+	}
+}
+
+func TestRetryOnContentMismatch(t *testing.T) {
+	for _, retries := range []int{0, 1} {
+		var requests atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) == 1 { // A cold cache answers with its HTML placeholder first
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte("<html><body>Please wait</body></html>"))
+				return
+			}
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Write(testPDF(1))
+		}))
+		setFlag(t, contentRetries, retries)
+		output := captureLog(t)
+		outputDir := t.TempDir()
+		downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+		_, err := downloader.downloadWithContentRetries(context.Background(), server.URL+"/sds/cold.pdf", outputDir, loadManifest(filepath.Join(outputDir, "manifest.json")))
+		server.Close()
+		switch {
+		case retries == 0 && (!errors.Is(err, ErrNotPDF) || requests.Load() != 1):
+			t.Errorf("without retries: err = %v after %d request(s), want ErrNotPDF after 1", err, requests.Load())
+		case retries == 1 && (err != nil || requests.Load() != 2):
+			t.Errorf("with 1 retry: err = %v after %d request(s), want success after 2", err, requests.Load())
+		case retries == 1 && !strings.Contains(output.String(), "Content mismatch for "+server.URL+"/sds/cold.pdf"):
+			t.Errorf("retry was not logged: %q", output)
+		}
+	}
+}
+
+func TestMinTLSRefusesOlderServers(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(testPDF(1))
+	}))
+	server.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11} // A legacy origin
+	server.StartTLS()
+	defer server.Close()
+
+	for version, accepted := range map[string]bool{"1.0": true, "1.1": true, "1.2": false, "1.3": false} {
+		transport := server.Client().Transport.(*http.Transport).Clone() // Trusts the test certificate
+		requireTLSVersion(transport, tlsVersions[version])
+		downloader := &Downloader{Client: &http.Client{Transport: transport}, Sanitizer: urlToFilename}
+		outputDir := t.TempDir()
+		_, err := downloader.downloadPDF(context.Background(), server.URL+"/sds/legacy.pdf", outputDir, loadManifest(filepath.Join(outputDir, "manifest.json")))
+		if accepted && err != nil {
+			t.Errorf("-min-tls %s against a TLS 1.1 server: %v", version, err)
+		} else if !accepted && !errors.Is(err, ErrNetwork) {
+			t.Errorf("-min-tls %s against a TLS 1.1 server = %v, want the connection refused", version, err)
+		}
+	}
+	for _, version := range []string{"", "1.4", "TLS1.2", "1"} { // Rejected at startup
+		if _, found := tlsVersions[version]; found {
+			t.Errorf("-min-tls %q is accepted", version)
+		}
+	}
+}
+
+func TestScriptPDFLinks(t *testing.T) {
+	tests := []struct {
+		script string
+		want   []string
+	}{
+		{`window.open('/sds/a.pdf', '_blank')`, []string{"/sds/a.pdf"}},
+		{`location.href = "/sds/b.pdf"`, []string{"/sds/b.pdf"}},
+		{`window.location='/sds/c.pdf'`, []string{"/sds/c.pdf"}},
+		{`if (location == '/sds/d.pdf') {}`, nil},
+		{`if (location.href === "/sds/e.pdf") {}`, nil},
+		{`if (location != '/sds/f.pdf') {}`, nil},
+		{`var allocation = 'budget.pdf'`, nil},
+		{`location.href = "/products/view/X"`, nil},
+	}
+	for _, test := range tests {
+		if got := scriptPDFLinks(test.script); !slices.Equal(got, test.want) {
+			t.Errorf("scriptPDFLinks(%q) = %q, want %q", test.script, got, test.want)
+		}
+	}
+}
+
+func TestAggressiveExtract(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    []string
+	}{
+		{"script_data_attribute.html", []string{
+			"/documents/sds/Dual_Blend_1_SDS_English.pdf",
+			"/documents/sds/Dual_Blend_1_SDS_Spanish.pdf",
+		}},
+		{"script_onclick.html", []string{
+			"/documents/sds/24_7_SDS_English.pdf",
+			"/documents/tds/24_7_TDS_English_GHS.pdf",
+		}},
+		{"script_location.html", []string{
+			"/documents/sds/AFIA_Alcohol_Based_SDS_English.pdf",
+			"/documents/flyers/AFIA_Flyer.pdf",
+		}},
+	}
+	for _, test := range tests {
+		page := readFixture(t, test.fixture)
+		setFlag(t, aggressiveExtract, false)
+		if got := extractPDFUrls(context.Background(), page); got != nil {
+			t.Errorf("%s without -aggressive-extract: extracted %q, want nothing", test.fixture, got)
+		}
+		setFlag(t, aggressiveExtract, true)
+		if got := extractPDFUrls(context.Background(), page); !slices.Equal(got, test.want) {
+			t.Errorf("%s with -aggressive-extract: extracted %q, want %q", test.fixture, got, test.want)
+		}
+	}
+}
+
+func TestCheckPDFStructureReadsCompressedFiles(t *testing.T) {
+	dir := t.TempDir()
+	valid := testPDF(1)
+	gzipped := func(data []byte) []byte {
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(data)
+		writer.Close()
+		return buffer.Bytes()
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"valid.pdf", valid, false},
+		{"valid.pdf.gz", gzipped(valid), false},
+		{"truncated.pdf", valid[:len(valid)/2], true},
+		{"truncated.pdf.gz", gzipped(valid[:len(valid)/2]), true},
+		{"notgzip.pdf.gz", valid, true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, test.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkPDFStructure(path); (err != nil) != test.wantErr {
+			t.Errorf("checkPDFStructure(%s) = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestPruneKeepsZipBundles(t *testing.T) {
+	setFlag(t, assumeYes, true)
+	outputDir := t.TempDir()
+	downloader := &Downloader{Client: http.DefaultClient, Sanitizer: urlToFilename}
+	urls := []string{
+		"https://www.nclonline.com/documents/sds/kit.zip",
+		"https://www.nclonline.com/documents/sds/foam.pdf",
+	}
+	kept := []string{bundlePath(urlToFilename(urls[0])), urlToFilename(urls[1]), urlToFilename(urls[1]) + ".gz"}
+	for _, name := range append([]string{"orphan.pdf", "orphan.zip"}, kept...) {
+		if err := os.WriteFile(filepath.Join(outputDir, name), []byte("%PDF-1.4"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if kept[0] != "kit.zip" {
+		t.Fatalf("bundle for %s is named %s, want kit.zip", urls[0], kept[0])
+	}
+
+	pruneFiles(outputDir, downloader.expectedFiles(urls, loadManifest(filepath.Join(outputDir, "manifest.json"))), true)
+	for _, name := range kept {
+		if !fileExists(filepath.Join(outputDir, name)) {
+			t.Errorf("%s was pruned", name)
+		}
+	}
+	for _, name := range []string{"orphan.pdf", "orphan.zip"} {
+		if !fileExists(filepath.Join(outputDir, "_removed", name)) {
+			t.Errorf("%s was not moved to _removed", name)
+		}
+	}
+}
+
+func TestLoadUserAgents(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"agents.txt":   "# Rotation pool\nAgent/1.0\n\n  Agent/2.0  \n",
+		"comments.txt": "# Nothing but comments\n\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	agents, err := loadUserAgents(filepath.Join(dir, "agents.txt"))
+	if want := []string{"Agent/1.0", "Agent/2.0"}; err != nil || !slices.Equal(agents, want) {
+		t.Errorf("loadUserAgents = %q, %v, want %q", agents, err, want)
+	}
+	for _, name := range []string{"comments.txt", "missing.txt"} {
+		if agents, err := loadUserAgents(filepath.Join(dir, name)); err == nil {
+			t.Errorf("loadUserAgents(%s) = %q, want an error", name, agents)
+		}
+	}
+}
+
+func TestChunkedDownload(t *testing.T) {
+	document := append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte("0123456789"), minChunkedSize/10+1)...)
+	for _, honorRanges := range []bool{true, false} {
+		var plain, ranged atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Accept-Ranges", "bytes")
+			if r.Header.Get("Range") == "" {
+				plain.Add(1)
+			} else if ranged.Add(1); !honorRanges { // A CDN that advertises ranges but serves the whole file
+				r.Header.Del("Range")
+			}
+			http.ServeContent(w, r, "big.pdf", time.Time{}, bytes.NewReader(document))
+		}))
+		setFlag(t, downloadChunks, 4)
+		outputDir := t.TempDir()
+		downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+		filePath, err := downloader.downloadPDF(context.Background(), server.URL+"/sds/big.pdf", outputDir, loadManifest(filepath.Join(outputDir, "manifest.json")))
+		server.Close()
+		if err != nil {
+			t.Fatalf("ranges honored %v: %v", honorRanges, err)
+		}
+		if saved, err := os.ReadFile(filePath); err != nil || !bytes.Equal(saved, document) {
+			t.Errorf("ranges honored %v: saved %d byte(s) (err %v), want the %d-byte document", honorRanges, len(saved), err, len(document))
+		}
+		wantPlain := 1 // The first request only tells the size
+		if !honorRanges {
+			wantPlain = 2 // Then one more for the single-stream fallback
+		}
+		if plain.Load() != int32(wantPlain) || ranged.Load() != 4 {
+			t.Errorf("ranges honored %v: %d plain and %d ranged request(s), want %d and 4", honorRanges, plain.Load(), ranged.Load(), wantPlain)
+		}
+	}
+}
+
+func TestURLListFiles(t *testing.T) {
+	separator := string(filepath.ListSeparator)
+	tests := []struct {
+		flagged []string
+		env     string
+		want    []string
+	}{
+		{nil, "", nil},
+		{[]string{"cleaners.txt"}, "", []string{"cleaners.txt"}},
+		{nil, "floor.txt" + separator + "hand.txt", []string{"floor.txt", "hand.txt"}},
+		{[]string{"cleaners.txt", "floor.txt"}, "floor.txt" + separator + separator + "hand.txt", []string{"cleaners.txt", "floor.txt", "hand.txt"}},
+	}
+	for _, test := range tests {
+		if got := urlListFiles(test.flagged, test.env); !slices.Equal(got, test.want) {
+			t.Errorf("urlListFiles(%q, %q) = %q, want %q", test.flagged, test.env, got, test.want)
+		}
+	}
+}
+
+func TestPruneSkippedWhenAPageFailsToFetch(t *testing.T) {
+	setFlag(t, assumeYes, true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/products/view/BROKEN" {
+			http.Error(w, "upstream timeout", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`<a href="/documents/sds/kept.pdf">SDS</a>`))
+	}))
+	defer server.Close()
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	outputDir := t.TempDir()
+	for _, name := range []string{"kept.pdf", "broken.pdf"} { // broken.pdf is linked from the page that fails
+		if err := os.WriteFile(filepath.Join(outputDir, name), []byte("%PDF-1.4"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var coverage scrapeCoverage
+	var discovered []string
+	for _, pageURL := range []string{server.URL + "/products/view/KEPT", server.URL + "/products/view/BROKEN"} {
+		content, err := downloader.getDataFromURL(context.Background(), pageURL)
+		if err != nil {
+			coverage.FailedPages = append(coverage.FailedPages, pageURL)
+			continue
+		}
+		for _, link := range extractPDFUrls(context.Background(), content) {
+			discovered = append(discovered, resolvePDFURL(pageURL, link))
+		}
+	}
+	if !slices.Equal(coverage.FailedPages, []string{server.URL + "/products/view/BROKEN"}) {
+		t.Fatalf("failed pages = %q, want only the 502 page", coverage.FailedPages)
+	}
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	downloader.pruneAfterScrape(outputDir, discovered, records, coverage, true)
+	for _, name := range []string{"kept.pdf", "broken.pdf"} {
+		if !fileExists(filepath.Join(outputDir, name)) {
+			t.Errorf("%s was pruned after an incomplete scrape", name)
+		}
+	}
+
+	for _, incomplete := range []scrapeCoverage{{Capped: true}, {Filtered: true}} {
+		if incomplete.incomplete() == "" {
+			t.Errorf("%+v allowed pruning", incomplete)
+		}
+	}
+	downloader.pruneAfterScrape(outputDir, discovered, records, scrapeCoverage{}, true)
+	if !fileExists(filepath.Join(outputDir, "_removed", "broken.pdf")) || !fileExists(filepath.Join(outputDir, "kept.pdf")) {
+		t.Error("a complete scrape did not prune only the unreferenced file")
+	}
+}
+
+func TestSaveDocumentKeepsTheOldCopyUntilTheNewOneIsWritten(t *testing.T) {
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	target := filepath.Join(outputDir, "foam.pdf")
+	if err := os.WriteFile(target, []byte("%PDF-1.4 good"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(target+".part", "busy"), 0o755); err != nil { // The temporary file cannot be created
+		t.Fatal(err)
+	}
+	if _, err := saveDocument(target, []byte("%PDF-1.4 new"), outputDir, records); err == nil {
+		t.Fatal("saveDocument succeeded without its temporary file")
+	}
+	if data, _ := os.ReadFile(target); string(data) != "%PDF-1.4 good" {
+		t.Errorf("failed save left %q, want the old copy", data)
+	}
+
+	if err := os.RemoveAll(target + ".part"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveDocument(target, []byte("%PDF-1.4 new"), outputDir, records); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "%PDF-1.4 new" {
+		t.Errorf("saved %q, want the new copy", data)
+	}
+	if fileExists(target + ".part") {
+		t.Error("the temporary file was left behind")
+	}
+}
+
+func TestSaveZipBundleChecksAndKeysEachEntry(t *testing.T) {
+	setFlag(t, onCollision, "suffix")
+	setFlag(t, minPages, 2)
+	var bundle bytes.Buffer
+	writer := zip.NewWriter(&bundle)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{"en/docs.pdf", testPDF(2)},
+		{"es/docs.pdf", testPDF(3)}, // Same base name in another folder
+		{"placeholder.pdf", testPDF(1)},
+		{"readme.pdf", []byte("<html>not a PDF</html>")},
+		{"../escape.pdf", testPDF(2)},
+	} {
+		file, err := writer.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(entry.data)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	downloader := &Downloader{Client: http.DefaultClient, Sanitizer: urlToFilename}
+	uri := "https://www.nclonline.com/documents/sds/kit.zip"
+
+	zipPath, err := downloader.saveZipBundle(context.Background(), uri, bundle.Bytes(), filepath.Join(outputDir, "kit_zip.pdf"), outputDir, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(zipPath); !bytes.Equal(data, bundle.Bytes()) || fileExists(zipPath+".part") {
+		t.Errorf("bundle saved as %d byte(s) at %s, want all %d with no .part file left", len(data), zipPath, bundle.Len())
+	}
+	for key, want := range map[string]string{
+		uri + "#en/docs.pdf":     "docs.pdf",
+		uri + "#es/docs.pdf":     "docs_2.pdf",
+		uri + "#placeholder.pdf": "", // Fewer pages than -min-pages
+		uri + "#readme.pdf":      "", // Not a PDF
+		uri:                      "", // The bundle itself is recorded by processURL
+	} {
+		if got := records.pathFor(key); got != want {
+			t.Errorf("pathFor(%s) = %q, want %q", key, got, want)
+		}
+	}
+	for _, name := range []string{"placeholder.pdf", "readme.pdf", "escape.pdf"} {
+		if fileExists(filepath.Join(outputDir, name)) {
+			t.Errorf("rejected entry %s was extracted", name)
+		}
+	}
+	if !records.urls()[uri] {
+		t.Error("bundle URL is not known to -dedupe-across-runs")
+	}
+	if missing := downloader.missingURLs([]string{uri}, outputDir, records); len(missing) != 0 {
+		t.Errorf("missingURLs() = %q, want the bundle counted as saved", missing)
+	}
+	expected := downloader.expectedFiles([]string{uri}, records)
+	for _, name := range []string{"kit.zip", "docs.pdf", "docs_2.pdf"} {
+		if !expected[name] {
+			t.Errorf("-prune would remove %s", name)
+		}
+	}
+}
+
+func TestNotifyWebhookFollowsPermanentRedirects(t *testing.T) {
+	var received webhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hooks/old" { // A moved endpoint must see the same POST again
+			http.Redirect(w, r, "/hooks/new", http.StatusPermanentRedirect)
+			return
+		}
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&received) != nil {
+			http.Error(w, "bad notification", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	setFlag(t, webhookURL, server.URL+"/hooks/old")
+	output := captureLog(t)
+
+	notifyWebhook(server.Client(), "completed", runSummary{Downloaded: 3}, nil)
+	if strings.Contains(output.String(), "Webhook notification failed") {
+		t.Errorf("notification failed: %s", output)
+	}
+	if received.Status != "completed" || received.New != 3 {
+		t.Errorf("redirected endpoint received %+v, want the completed run with 3 new files", received)
+	}
+}
+
+// Runs main with the arguments in NCL_MAIN_HELPER, one per line; started by tests
+// that need to see the run exit
+func TestMainHelperProcess(t *testing.T) {
+	args := os.Getenv("NCL_MAIN_HELPER")
+	if args == "" {
+		t.Skip("helper process only")
+	}
+	os.Args = append([]string{os.Args[0]}, strings.Split(args, "\n")...)
+	main()
+	os.Exit(0)
+}
+
+// Runs main in a helper process in a fresh directory and returns its exit code and log
+func runMain(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	helper := exec.Command(os.Args[0], "-test.run=^TestMainHelperProcess$")
+	helper.Dir = t.TempDir()
+	helper.Env = append(os.Environ(), "NCL_MAIN_HELPER="+strings.Join(args, "\n"), urlsEnv+"=")
+	output, err := helper.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), string(output)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0, string(output)
+}
+
+func TestMissingListFileAbortsTheRun(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`<a href="/documents/sds/foam.pdf">SDS</a>`))
+	}))
+	defer server.Close()
+	list := filepath.Join(t.TempDir(), "foam.txt")
+	if err := os.WriteFile(list, []byte(server.URL+"/products/view/FOAM\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "typo.txt")
+	for name, args := range map[string][]string{
+		"-urls":         {"-urls", list, "-urls", missing, "-prune"},
+		"-slugs":        {"-urls", list, "-slugs", missing},
+		"-exclude-file": {"-urls", list, "-exclude-file", missing},
+	} {
+		code, output := runMain(t, args...)
+		if code != exitFatal || !strings.Contains(output, "typo.txt") {
+			t.Errorf("%s naming a missing file: exit code %d, want %d naming the file; log:\n%s", name, code, exitFatal, output)
+		}
+	}
+	if requests.Load() != 1 { // Only -exclude-file is read after scraping
+		t.Errorf("server saw %d request(s), want only the -exclude-file run to scrape", requests.Load())
+	}
+}
+
+func TestLoadExpectedHashesRejectsMissingAndMalformedFiles(t *testing.T) {
+	dir := t.TempDir()
+	digest := strings.Repeat("ab", sha256.Size)
+	hashes := filepath.Join(dir, "approved.sha256")
+	content := digest + "  PDFs/foam.pdf\nnot-a-digest  bleach.pdf\n"
+	if err := os.WriteFile(hashes, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, err := loadExpectedHashes(hashes, false); err != nil || len(expected) != 1 || expected["foam.pdf"] != digest {
+		t.Errorf("lenient load = %v, %v; want only foam.pdf pinned", expected, err)
+	}
+	if _, err := loadExpectedHashes(hashes, true); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("strict load of a malformed line = %v, want an error naming line 2", err)
+	}
+	if _, err := loadExpectedHashes(filepath.Join(dir, "missing.sha256"), false); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+	if code, output := runMain(t, "-expected-hashes", filepath.Join(dir, "missing.sha256"), "-strict"); code != exitFatal {
+		t.Errorf("run with a missing -expected-hashes exited %d, want %d; log:\n%s", code, exitFatal, output)
+	}
+}
+
+func TestDownloadImageRecordsItInTheManifest(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	}))
+	defer server.Close()
+	downloader := &Downloader{Client: server.Client(), Sanitizer: urlToFilename}
+	outputDir := t.TempDir()
+	records := loadManifest(filepath.Join(outputDir, "manifest.json"))
+	image := productImage{URL: server.URL + "/images/products/front.png", Product: server.URL + "/products/view/DUAL_BLEND_1"}
+
+	filePath, err := downloader.downloadImage(context.Background(), image, outputDir, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filePath); !bytes.Equal(data, png) {
+		t.Errorf("saved %d byte(s), want the %d-byte image", len(data), len(png))
+	}
+	if fileExists(filePath + ".part") {
+		t.Error("the temporary file was left behind")
+	}
+	if got, want := records.pathFor(image.URL), "images/"+filepath.Base(filePath); got != want {
+		t.Errorf("manifest path for the image = %q, want %q", got, want)
+	}
+	if entry := records.lookup(records.pathFor(image.URL)); entry.Source != image.Product {
+		t.Errorf("manifest source = %q, want the product page", entry.Source)
+	}
+	if _, err := downloader.downloadImage(context.Background(), image, outputDir, records); !errors.Is(err, ErrFileExists) {
+		t.Errorf("second download = %v, want ErrFileExists", err)
+	}
+}
+
+func TestBundlePathUnderEachFilenameMode(t *testing.T) {
+	for mode, sanitize := range filenameModes {
+		for _, uri := range []string{
+			"https://www.nclonline.com/documents/sds/Bundle.zip",
+			"https://www.nclonline.com/documents/sds/Bundle.ZIP",
+		} {
+			got := bundlePath(sanitize(uri))
+			if want := map[string]string{"strict": "bundle.zip", "relaxed": "Bundle.zip"}[mode]; got != want {
+				t.Errorf("%s: bundlePath(%q) = %q, want %q", mode, sanitize(uri), got, want)
+			}
+		}
+	}
+}